@@ -0,0 +1,181 @@
+package adapters
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+)
+
+// DefaultStmtCacheSize is the number of prepared statements cached by default
+const DefaultStmtCacheSize = 100
+
+// StmtCacheStats reports usage of a prepared statement cache
+type StmtCacheStats struct {
+	Size      int
+	Capacity  int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// StmtCache is a concurrency-safe cache of prepared statements keyed by SQL text,
+// the least recently used statement is evicted when the cache is full.
+// Statements are reference counted while checked out, so that an evicted statement
+// is closed only once the last caller using it has released it.
+type StmtCache struct {
+	mu       sync.Mutex
+	sqlDB    *sql.DB
+	capacity int
+	lru      *list.List
+	stmts    map[string]*list.Element
+	stats    StmtCacheStats
+}
+
+// cachedStmt is the value stored in the lru list
+type cachedStmt struct {
+	query string
+	stmt  *sql.Stmt
+
+	// The number of callers using the statement, and whether it has left the cache
+	refs    int
+	evicted bool
+}
+
+// NewStmtCache returns a cache of statements prepared on sqlDB, holding at most capacity statements
+// If capacity is 0 or less the cache is disabled.
+func NewStmtCache(sqlDB *sql.DB, capacity int) *StmtCache {
+	return &StmtCache{
+		sqlDB:    sqlDB,
+		capacity: capacity,
+		lru:      list.New(),
+		stmts:    make(map[string]*list.Element),
+	}
+}
+
+// Enabled reports whether statements are cached
+func (c *StmtCache) Enabled() bool {
+	return c != nil && c.capacity > 0 && c.sqlDB != nil
+}
+
+// Get returns the cached statement for query and a func to release it, or nil if it has not been prepared.
+// The caller must call release once it has finished executing the statement.
+func (c *StmtCache) Get(query string) (stmt *sql.Stmt, release func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.stmts[query]; ok {
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		return c.checkout(e.Value.(*cachedStmt))
+	}
+	c.stats.Misses++
+	return nil, nil
+}
+
+// Prepare returns a prepared statement for query from the cache, preparing it if required,
+// and a func to release it. The statement must not be closed by the caller, who must call
+// release once it has finished executing the statement (rows it returned may remain open).
+func (c *StmtCache) Prepare(ctx context.Context, query string) (stmt *sql.Stmt, release func(), err error) {
+
+	stmt, release = c.Get(query)
+	if stmt != nil {
+		return stmt, release, nil
+	}
+
+	// Prepare outside the lock, so that slow prepares don't block other queries
+	stmt, err = c.sqlDB.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another caller may have prepared the same query while we were unlocked
+	if e, ok := c.stmts[query]; ok {
+		stmt.Close()
+		c.lru.MoveToFront(e)
+		stmt, release = c.checkout(e.Value.(*cachedStmt))
+		return stmt, release, nil
+	}
+
+	cs := &cachedStmt{query: query, stmt: stmt}
+	c.stmts[query] = c.lru.PushFront(cs)
+	stmt, release = c.checkout(cs)
+
+	// Evict the least recently used statements if over capacity,
+	// they are closed once released by any callers still using them
+	for c.lru.Len() > c.capacity {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		c.evict(e.Value.(*cachedStmt))
+		c.stats.Evictions++
+	}
+
+	return stmt, release, nil
+}
+
+// checkout adds a reference to cs and returns its statement with a func to release it,
+// the lock must be held
+func (c *StmtCache) checkout(cs *cachedStmt) (*sql.Stmt, func()) {
+	cs.refs++
+	var once sync.Once
+	return cs.stmt, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			cs.refs--
+			if cs.evicted && cs.refs == 0 {
+				cs.stmt.Close()
+			}
+		})
+	}
+}
+
+// evict removes cs from the cache map, closing it now if no callers are using it,
+// the lock must be held
+func (c *StmtCache) evict(cs *cachedStmt) {
+	delete(c.stmts, cs.query)
+	cs.evicted = true
+	if cs.refs == 0 {
+		cs.stmt.Close()
+	}
+}
+
+// Stats returns usage statistics for the cache
+func (c *StmtCache) Stats() StmtCacheStats {
+	if c == nil {
+		return StmtCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+// Clear removes all cached statements, closing them once released by any callers using them
+func (c *StmtCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		c.evict(e.Value.(*cachedStmt))
+	}
+	c.lru.Init()
+	c.stmts = make(map[string]*list.Element)
+}
+
+// stmtCacheSize returns the cache size set in opts with stmt_cache_size,
+// a size of 0 disables the cache
+func stmtCacheSize(opts map[string]string) int {
+	size, err := strconv.Atoi(opts["stmt_cache_size"])
+	if err != nil {
+		return DefaultStmtCacheSize
+	}
+	return size
+}
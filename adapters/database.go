@@ -2,8 +2,12 @@
 package adapters
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
 	"time"
 )
 
@@ -12,35 +16,187 @@ type Database interface {
 
 	// Open and close
 	Open(opts map[string]string) error
+	OpenWithSQLDB(sqlDB *sql.DB, opts map[string]string) error
 	Close() error
 	SQLDB() *sql.DB
 
+	// Return a copy of this adapter which executes statements on the given transaction
+	WithTx(tx *sql.Tx) Database
+
 	// Execute queries with or without returned rows
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
 
+	// Execute queries with or without returned rows, using the given context
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+
 	// Insert a record, returning id
 	Insert(sql string, args ...interface{}) (id int64, err error)
+	InsertContext(ctx context.Context, sql string, args ...interface{}) (id int64, err error)
 
 	// Return extra SQL for insert statement (see psql)
 	InsertSQL(pk string) string
 
+	// Return SQL to set, roll back to and release a savepoint within a transaction
+	SavepointSQL(name string) string
+	RollbackSavepointSQL(name string) string
+	ReleaseSavepointSQL(name string) string
+
 	// A format string for the arg placeholder
 	Placeholder(i int) string
 
 	// Quote Table and Column names
 	QuoteField(name string) string
 
+	// Report whether a backslash escapes the next character in quoted strings (see mysql)
+	BackslashEscapes() bool
+
 	// Convert a time to a string
 	TimeString(t time.Time) string
 
 	// Convert a string to a time
 	ParseTime(s string) (time.Time, error)
+
+	// Report whether an error is a transient failure which can be fixed by retrying the transaction
+	IsRetryable(err error) bool
+
+	// Report usage of the prepared statement cache
+	StmtCacheStats() StmtCacheStats
+
+	// Set the logger used for diagnostic output
+	SetLogger(logger *slog.Logger)
+
+	// Return the most values bound in one IN list, longer lists are split into chunks (0 for no limit)
+	InChunkSize() int
+
+	// Return values as a single array arg for col = ANY(?) if supported (see psql)
+	ArrayArg(values interface{}) (interface{}, bool)
+}
+
+// Executor is satisfied by both *sql.DB and *sql.Tx, and is used to execute statements
+type Executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 // Adapter is a struct defining a few functions used by all adapters
 type Adapter struct {
-	queries map[string]interface{}
+	stmts       *StmtCache
+	logger      *slog.Logger
+	inChunkSize int
+
+	// The sqlDB is owned by the caller of OpenWithSQLDB, so is not closed on Close
+	borrowed bool
+}
+
+// DefaultInChunkSize is the most values bound in one IN list by default, well under
+// the bind parameter limits of postgres (65535) and sqlite (32766)
+const DefaultInChunkSize = 10000
+
+// discardLogger is used when no logger has been set, so that nothing is written to stdout
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newAdapter returns an Adapter with a prepared statement cache on sqlDB,
+// the cache size is set with the stmt_cache_size option, and 0 disables it.
+// The in_chunk_size option sets the most values bound in one IN list, and 0 disables chunking.
+func newAdapter(sqlDB *sql.DB, opts map[string]string) *Adapter {
+	return &Adapter{
+		stmts:       NewStmtCache(sqlDB, stmtCacheSize(opts)),
+		inChunkSize: inChunkSize(opts),
+	}
+}
+
+// openSQLDB opens a pool with the driver and data source given, returning it with an Adapter
+// which caches prepared statements on the pool and closes it on Close
+func openSQLDB(driver, dataSource string, opts map[string]string) (*sql.DB, *Adapter, error) {
+	sqlDB, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sqlDB, newAdapter(sqlDB, opts), nil
+}
+
+// borrowSQLDB returns an Adapter for an existing sqlDB owned by the caller, which is not closed on Close,
+// with the options given merged over the adapter name
+func borrowSQLDB(sqlDB *sql.DB, name string, opts map[string]string) (*Adapter, map[string]string, error) {
+	if sqlDB == nil {
+		return nil, nil, fmt.Errorf("No database available.")
+	}
+
+	options := map[string]string{
+		"adapter": name,
+	}
+	for k, v := range opts {
+		options[k] = v
+	}
+
+	db := newAdapter(sqlDB, options)
+	db.borrowed = true
+	return db, options, nil
+}
+
+// inChunkSize returns the chunk size set in opts with in_chunk_size
+func inChunkSize(opts map[string]string) int {
+	size, err := strconv.Atoi(opts["in_chunk_size"])
+	if err != nil {
+		return DefaultInChunkSize
+	}
+	return size
+}
+
+// InChunkSize returns the most values bound in one IN list before it is split into chunks, 0 for no limit
+func (db *Adapter) InChunkSize() int {
+	if db == nil {
+		return DefaultInChunkSize
+	}
+	return db.inChunkSize
+}
+
+// ArrayArg is not supported by default, so long IN lists are split into chunks
+func (db *Adapter) ArrayArg(values interface{}) (interface{}, bool) {
+	return nil, false
+}
+
+// SetLogger sets the logger used for diagnostic output from this adapter
+func (db *Adapter) SetLogger(logger *slog.Logger) {
+	if db != nil {
+		db.logger = logger
+	}
+}
+
+// log returns the logger for this adapter, which discards output if none is set
+func (db *Adapter) log() *slog.Logger {
+	if db == nil || db.logger == nil {
+		return discardLogger
+	}
+	return db.logger
+}
+
+// StmtCacheStats returns usage statistics for the prepared statement cache
+func (db *Adapter) StmtCacheStats() StmtCacheStats {
+	if db == nil {
+		return StmtCacheStats{}
+	}
+	return db.stmts.Stats()
+}
+
+// closeStmts closes all cached statements, this must be called before the database is closed
+func (db *Adapter) closeStmts() {
+	if db != nil {
+		db.stmts.Clear()
+	}
+}
+
+// closeDB closes all cached statements and then sqlDB, unless it was borrowed with OpenWithSQLDB
+func (db *Adapter) closeDB(sqlDB *sql.DB) error {
+	db.closeStmts()
+	if db != nil && db.borrowed {
+		return nil
+	}
+	return sqlDB.Close()
 }
 
 // ReplaceArgPlaceholder does no replacements by default, and use default ? placeholder for args
@@ -78,7 +234,7 @@ func (db *Adapter) ParseTime(s string) (time.Time, error) {
 
 	t, err := time.Parse(format, s)
 	if err != nil {
-		fmt.Println("Unhandled field type:", s, "\n", err)
+		db.log().Warn("query: unhandled time format", "value", s, "error", err)
 	}
 
 	return t, err
@@ -89,32 +245,96 @@ func (db *Adapter) QuoteField(name string) string {
 	return fmt.Sprintf(`"%s"`, name)
 }
 
+// BackslashEscapes reports whether a backslash escapes the next character in quoted strings,
+// by default only doubled quotes are escapes, as in standard sql
+func (db *Adapter) BackslashEscapes() bool {
+	return false
+}
+
 // InsertSQL provides extra SQL for end of insert statement (RETURNING for psql)
 func (db *Adapter) InsertSQL(pk string) string {
 	return ""
 }
 
+// IsRetryable reports whether the error is a serialization failure or deadlock
+// by default no errors are considered retryable
+func (db *Adapter) IsRetryable(err error) bool {
+	return false
+}
+
+// SavepointSQL returns the SQL to set a savepoint within a transaction
+func (db *Adapter) SavepointSQL(name string) string {
+	return fmt.Sprintf("SAVEPOINT %s", name)
+}
+
+// RollbackSavepointSQL returns the SQL to roll back to a savepoint
+func (db *Adapter) RollbackSavepointSQL(name string) string {
+	return fmt.Sprintf("ROLLBACK TO SAVEPOINT %s", name)
+}
+
+// ReleaseSavepointSQL returns the SQL to release a savepoint
+func (db *Adapter) ReleaseSavepointSQL(name string) string {
+	return fmt.Sprintf("RELEASE SAVEPOINT %s", name)
+}
+
+// executor returns the transaction if we have one, or the sqlDB if not
+// nil is returned if neither is available
+func (db *Adapter) executor(sqlDB *sql.DB, tx *sql.Tx) Executor {
+	if tx != nil {
+		return tx
+	}
+	if sqlDB != nil {
+		return sqlDB
+	}
+	return nil
+}
+
+// prepare returns a statement prepared on ex for query, using the statement cache if enabled.
+// The caller must call release once it has finished executing the statement.
+func (db *Adapter) prepare(ctx context.Context, ex Executor, query string) (stmt *sql.Stmt, release func(), err error) {
+
+	cached := db != nil && db.stmts.Enabled()
+
+	// Statements used within a transaction must be bound to it, and are not prepared
+	// on the pool as this may require another connection while the transaction holds one.
+	// They are closed when the transaction ends, as closing them here would close open rows.
+	if tx, ok := ex.(*sql.Tx); ok {
+		if cached {
+			stmt, release = db.stmts.Get(query)
+			if stmt != nil {
+				return tx.StmtContext(ctx, stmt), release, nil
+			}
+		}
+		stmt, err = tx.PrepareContext(ctx, query)
+		return stmt, func() {}, err
+	}
+
+	if !cached {
+		stmt, err = ex.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stmt, func() { stmt.Close() }, nil
+	}
+
+	return db.stmts.Prepare(ctx, query)
+}
+
 // performQuery executes Query SQL on the given sqlDB and return the rows.
 // NB caller must call use defer rows.Close() with rows returned
-func (db *Adapter) performQuery(sqlDB *sql.DB, debug bool, query string, args ...interface{}) (*sql.Rows, error) {
+func (db *Adapter) performQuery(ctx context.Context, sqlDB Executor, query string, args ...interface{}) (*sql.Rows, error) {
 
 	if sqlDB == nil {
 		return nil, fmt.Errorf("No database available.")
 	}
 
-	if debug {
-		fmt.Println("QUERY:", query, "ARGS", args)
-	}
-
-	// This should be cached, perhaps hold a map in memory of queries strings and compiled queries?
-	// use queries map to store this
-	stmt, err := sqlDB.Prepare(query)
+	stmt, release, err := db.prepare(ctx, sqlDB, query)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	defer release()
 
-	rows, err := stmt.Query(args...)
+	rows, err := stmt.QueryContext(ctx, args...)
 
 	if err != nil {
 		return nil, err
@@ -125,23 +345,19 @@ func (db *Adapter) performQuery(sqlDB *sql.DB, debug bool, query string, args ..
 }
 
 // performExec executes Query SQL on the given sqlDB with no rows returned, just result
-func (db *Adapter) performExec(sqlDB *sql.DB, debug bool, query string, args ...interface{}) (sql.Result, error) {
+func (db *Adapter) performExec(ctx context.Context, sqlDB Executor, query string, args ...interface{}) (sql.Result, error) {
 
 	if sqlDB == nil {
 		return nil, fmt.Errorf("No database available.")
 	}
 
-	if debug {
-		fmt.Println("QUERY:", query, "ARGS", args)
-	}
-
-	stmt, err := sqlDB.Prepare(query)
+	stmt, release, err := db.prepare(ctx, sqlDB, query)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	defer release()
 
-	result, err := stmt.Exec(args...)
+	result, err := stmt.ExecContext(ctx, args...)
 
 	if err != nil {
 		return result, err
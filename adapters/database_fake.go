@@ -0,0 +1,422 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FakeAdapter conforms to the query.Database interface without requiring a database.
+// It records every statement executed, and returns rows, results or errors scripted
+// with ExpectQuery, ExpectExec and ExpectInsert, so that code built on query can be unit tested.
+// Statements which match no expectation return no rows and an empty result.
+// Like mysql, savepoint statements may not be prepared, and must be executed directly.
+type FakeAdapter struct {
+	*Adapter
+	options map[string]string
+	sqlDB   *sql.DB
+	tx      *sql.Tx
+
+	// Recorded calls and expectations, shared with copies made by WithTx
+	state *fakeState
+}
+
+// fakeState holds the calls and expectations for a fake adapter
+type fakeState struct {
+	mu           sync.Mutex
+	calls        []FakeCall
+	expectations []*FakeExpectation
+}
+
+// FakeCall records a statement executed by the fake adapter
+// Method is one of Query, Exec, Insert, Begin, Commit or Rollback
+// Args are recorded after conversion to driver values (so int becomes int64)
+type FakeCall struct {
+	Method string
+	SQL    string
+	Args   []interface{}
+}
+
+// FakeExpectation scripts the response to statements matching a pattern
+type FakeExpectation struct {
+	method  string
+	pattern *regexp.Regexp
+
+	columns      []string
+	rows         [][]driver.Value
+	lastInsertID int64
+	rowsAffected int64
+	err          error
+
+	matched int
+}
+
+// Open the fake database, no options are required
+func (db *FakeAdapter) Open(opts map[string]string) error {
+
+	db.options = map[string]string{
+		"adapter": "fake",
+	}
+
+	for k, v := range opts {
+		db.options[k] = v
+	}
+
+	db.fake()
+	db.sqlDB = sql.OpenDB(&fakeConnector{state: db.state})
+	db.Adapter = newAdapter(db.sqlDB, db.options)
+
+	return nil
+}
+
+// OpenWithSQLDB is not supported by the fake adapter, which provides its own sqlDB
+func (db *FakeAdapter) OpenWithSQLDB(sqlDB *sql.DB, opts map[string]string) error {
+	return fmt.Errorf("fake: OpenWithSQLDB is not supported")
+}
+
+// Close the database
+func (db *FakeAdapter) Close() error {
+	if db.sqlDB != nil {
+		return db.closeDB(db.sqlDB)
+	}
+	return nil
+}
+
+// SQLDB returns the internal db.sqlDB pointer
+func (db *FakeAdapter) SQLDB() *sql.DB {
+	return db.sqlDB
+}
+
+// IsRetryable reports whether the error would be retried by the postgres or mysql adapters,
+// so that serialization failures (40001) and deadlocks (1213) may be scripted with WillReturnError
+func (db *FakeAdapter) IsRetryable(err error) bool {
+	return (&PostgresqlAdapter{}).IsRetryable(err) || (&MysqlAdapter{}).IsRetryable(err)
+}
+
+// WithTx returns a copy of this adapter which executes statements on the given transaction
+func (db *FakeAdapter) WithTx(tx *sql.Tx) Database {
+	txdb := *db
+	txdb.tx = tx
+	return &txdb
+}
+
+// Query executes query SQL - NB caller must call use defer rows.Close() with rows returned
+func (db *FakeAdapter) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext executes query SQL with the given context - NB caller must call use defer rows.Close() with rows returned
+func (db *FakeAdapter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.performQuery(ctx, db.executor(db.sqlDB, db.tx), query, args...)
+}
+
+// Exec - use this for non-select statements
+func (db *FakeAdapter) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext - use this for non-select statements with the given context
+func (db *FakeAdapter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.performExec(ctx, db.executor(db.sqlDB, db.tx), query, args...)
+}
+
+// Insert a record with params and return the id
+func (db *FakeAdapter) Insert(query string, args ...interface{}) (id int64, err error) {
+	return db.InsertContext(context.Background(), query, args...)
+}
+
+// InsertContext inserts a record with params using the given context and returns the id
+func (db *FakeAdapter) InsertContext(ctx context.Context, query string, args ...interface{}) (id int64, err error) {
+
+	// Mark the statement so that it is recorded and matched as an insert
+	result, err := db.ExecContext(context.WithValue(ctx, fakeInsertKey{}, true), query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// ExpectQuery scripts the response to queries matching the regexp pattern
+func (db *FakeAdapter) ExpectQuery(pattern string) *FakeExpectation {
+	return db.expect("Query", pattern)
+}
+
+// ExpectExec scripts the response to statements executed without rows matching the regexp pattern
+func (db *FakeAdapter) ExpectExec(pattern string) *FakeExpectation {
+	return db.expect("Exec", pattern)
+}
+
+// ExpectInsert scripts the response to inserts matching the regexp pattern
+func (db *FakeAdapter) ExpectInsert(pattern string) *FakeExpectation {
+	return db.expect("Insert", pattern)
+}
+
+// Calls returns a copy of the calls recorded so far
+func (db *FakeAdapter) Calls() []FakeCall {
+	s := db.fake()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]FakeCall(nil), s.calls...)
+}
+
+// ExpectationsMet returns an error listing any expectations which have not been matched
+func (db *FakeAdapter) ExpectationsMet() error {
+	s := db.fake()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unmet []string
+	for _, e := range s.expectations {
+		if e.matched == 0 {
+			unmet = append(unmet, fmt.Sprintf("%s %s", e.method, e.pattern))
+		}
+	}
+	if len(unmet) > 0 {
+		return fmt.Errorf("fake: expectations not met:\n%s", strings.Join(unmet, "\n"))
+	}
+	return nil
+}
+
+// Reset clears all recorded calls and expectations
+func (db *FakeAdapter) Reset() {
+	s := db.fake()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+	s.expectations = nil
+}
+
+// fake returns the state for this adapter, creating it if required
+func (db *FakeAdapter) fake() *fakeState {
+	if db.state == nil {
+		db.state = &fakeState{}
+	}
+	return db.state
+}
+
+// expect adds an expectation for the method and pattern
+func (db *FakeAdapter) expect(method, pattern string) *FakeExpectation {
+	e := &FakeExpectation{
+		method:       method,
+		pattern:      regexp.MustCompile(pattern),
+		rowsAffected: 1,
+	}
+	s := db.fake()
+	s.mu.Lock()
+	s.expectations = append(s.expectations, e)
+	s.mu.Unlock()
+	return e
+}
+
+// WillReturnRows sets the columns and rows returned by a query
+func (e *FakeExpectation) WillReturnRows(columns []string, rows ...[]interface{}) *FakeExpectation {
+	e.columns = columns
+	e.rows = nil
+	for _, row := range rows {
+		values := make([]driver.Value, len(row))
+		for i, v := range row {
+			dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+			if err != nil {
+				dv = v
+			}
+			values[i] = dv
+		}
+		e.rows = append(e.rows, values)
+	}
+	return e
+}
+
+// WillReturnResult sets the last insert id and rows affected for an exec or insert
+func (e *FakeExpectation) WillReturnResult(lastInsertID, rowsAffected int64) *FakeExpectation {
+	e.lastInsertID = lastInsertID
+	e.rowsAffected = rowsAffected
+	return e
+}
+
+// WillReturnError sets the error returned when the expectation is matched
+func (e *FakeExpectation) WillReturnError(err error) *FakeExpectation {
+	e.err = err
+	return e
+}
+
+// record records a call and returns the first expectation matching it, or nil
+func (s *fakeState) record(method, query string, args []driver.NamedValue) *FakeExpectation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	call := FakeCall{Method: method, SQL: query}
+	for _, a := range args {
+		call.Args = append(call.Args, a.Value)
+	}
+	s.calls = append(s.calls, call)
+
+	for _, e := range s.expectations {
+		if e.method == method && e.pattern.MatchString(query) {
+			e.matched++
+			return e
+		}
+	}
+	return nil
+}
+
+// fakeInsertKey is the context key used to mark inserts
+type fakeInsertKey struct{}
+
+// The types below implement a database/sql driver which answers from the fake state
+
+type fakeConnector struct {
+	state *fakeState
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{state: c.state}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, fmt.Errorf("fake: open by name is not supported")
+}
+
+type fakeConn struct {
+	state *fakeState
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.Contains(strings.ToUpper(query), "SAVEPOINT") {
+		return nil, fmt.Errorf("fake: savepoint statements may not be prepared: %s", query)
+	}
+	return &fakeStmt{state: c.state, query: query}, nil
+}
+
+// ExecContext executes statements directly without preparing them
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return (&fakeStmt{state: c.state, query: query}).ExecContext(ctx, args)
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.state.record("Begin", "", nil)
+	return &fakeTx{state: c.state}, nil
+}
+
+type fakeTx struct {
+	state *fakeState
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.state.record("Commit", "", nil)
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.state.record("Rollback", "", nil)
+	return nil
+}
+
+type fakeStmt struct {
+	state *fakeState
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	method := "Exec"
+	if ctx.Value(fakeInsertKey{}) != nil {
+		method = "Insert"
+	}
+	e := s.state.record(method, s.query, args)
+	if e == nil {
+		return fakeResult{}, nil
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return fakeResult{lastInsertID: e.lastInsertID, rowsAffected: e.rowsAffected}, nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	e := s.state.record("Query", s.query, args)
+	if e == nil {
+		return &fakeRows{}, nil
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return &fakeRows{columns: e.columns, rows: e.rows}, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, a := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+	}
+	return named
+}
+
+type fakeResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.lastInsertID, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	i       int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
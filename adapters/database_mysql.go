@@ -1,11 +1,13 @@
 package adapters
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
 	// Mysql driver
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 // MysqlAdapter conforms to the query.Database interface
@@ -13,13 +15,13 @@ type MysqlAdapter struct {
 	*Adapter
 	options map[string]string
 	sqlDB   *sql.DB
-	debug   bool
+	tx      *sql.Tx
 }
 
 // Open this database
+// in_chunk_size sets the most values in an IN list (default 10000), longer lists are split into chunks
 func (db *MysqlAdapter) Open(opts map[string]string) error {
 
-	db.debug = false
 	db.options = map[string]string{
 		"adapter":  "mysql",
 		"user":     "root", // sub your user
@@ -31,10 +33,6 @@ func (db *MysqlAdapter) Open(opts map[string]string) error {
 		"params":   "charset=utf8&parseTime=true",
 	}
 
-	if opts["debug"] == "true" {
-		db.debug = true
-	}
-
 	// Merge options
 	for k, v := range opts {
 		db.options[k] = v
@@ -52,13 +50,12 @@ func (db *MysqlAdapter) Open(opts map[string]string) error {
 		db.options["params"])
 
 	var err error
-	db.sqlDB, err = sql.Open(db.options["adapter"], options)
+	db.sqlDB, db.Adapter, err = openSQLDB(db.options["adapter"], options, db.options)
 	if err != nil {
 		return err
 	}
 
 	if db.sqlDB == nil {
-		fmt.Printf("Mysql options:%s", options)
 		return fmt.Errorf("\nError creating database with options: %v", db.options)
 	}
 
@@ -72,10 +69,22 @@ func (db *MysqlAdapter) Open(opts map[string]string) error {
 
 }
 
+// OpenWithSQLDB uses the existing sqlDB given rather than opening a new connection,
+// sqlDB remains owned by the caller and is not closed on Close
+func (db *MysqlAdapter) OpenWithSQLDB(sqlDB *sql.DB, opts map[string]string) (err error) {
+	db.Adapter, db.options, err = borrowSQLDB(sqlDB, "mysql", opts)
+	if err != nil {
+		return err
+	}
+	db.sqlDB = sqlDB
+
+	return nil
+}
+
 // Close the database
 func (db *MysqlAdapter) Close() error {
 	if db.sqlDB != nil {
-		return db.sqlDB.Close()
+		return db.closeDB(db.sqlDB)
 	}
 	return nil
 }
@@ -85,14 +94,31 @@ func (db *MysqlAdapter) SQLDB() *sql.DB {
 	return db.sqlDB
 }
 
+// WithTx returns a copy of this adapter which executes statements on the given transaction
+func (db *MysqlAdapter) WithTx(tx *sql.Tx) Database {
+	txdb := *db
+	txdb.tx = tx
+	return &txdb
+}
+
 // Query SQL execute - NB caller must call use defer rows.Close() with rows returned
 func (db *MysqlAdapter) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return db.performQuery(db.sqlDB, db.debug, query, args...)
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext executes query SQL with the given context - NB caller must call use defer rows.Close() with rows returned
+func (db *MysqlAdapter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.performQuery(ctx, db.executor(db.sqlDB, db.tx), query, args...)
 }
 
 // Exec - use this for non-select statements
 func (db *MysqlAdapter) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return db.performExec(db.sqlDB, db.debug, query, args...)
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext - use this for non-select statements with the given context
+func (db *MysqlAdapter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.performExec(ctx, db.executor(db.sqlDB, db.tx), query, args...)
 }
 
 // QuoteField quotes a table name or column name
@@ -100,24 +126,51 @@ func (db *MysqlAdapter) QuoteField(name string) string {
 	return fmt.Sprintf("`%s`", name)
 }
 
+// BackslashEscapes reports true, as mysql treats a backslash in quoted strings as an escape
+// unless the NO_BACKSLASH_ESCAPES sql mode is set
+func (db *MysqlAdapter) BackslashEscapes() bool {
+	return true
+}
+
+// IsRetryable reports whether the error is a deadlock (1213) or lock wait timeout (1205)
+// which may succeed if the transaction is run again
+func (db *MysqlAdapter) IsRetryable(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case 1213, 1205:
+			return true
+		}
+	}
+	return false
+}
+
 // Insert a record with params and return the id - psql behaves differently
 func (db *MysqlAdapter) Insert(query string, args ...interface{}) (id int64, err error) {
+	return db.InsertContext(context.Background(), query, args...)
+}
 
-	tx, err := db.sqlDB.Begin()
-	if err != nil {
-		return 0, err
+// InsertContext inserts a record with params using the given context and returns the id
+// The insert is executed on a transaction, or on the current one if the adapter has one
+func (db *MysqlAdapter) InsertContext(ctx context.Context, query string, args ...interface{}) (id int64, err error) {
+
+	// If we are already within a transaction, insert on that
+	if db.tx != nil {
+		return db.insert(ctx, db.tx, query, args...)
 	}
 
-	// Execute the sql using db
-	result, err := db.Exec(query, args...)
+	if db.sqlDB == nil {
+		return 0, fmt.Errorf("No database available.")
+	}
+
+	tx, err := db.sqlDB.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, err
 	}
 
-	// TODO - check this works on mysql under load with concurrent connections
-	// fine if connection not shared
-	id, err = result.LastInsertId()
+	id, err = db.insert(ctx, tx, query, args...)
 	if err != nil {
+		tx.Rollback()
 		return 0, err
 	}
 
@@ -129,3 +182,15 @@ func (db *MysqlAdapter) Insert(query string, args ...interface{}) (id int64, err
 	return id, nil
 
 }
+
+// insert executes the insert sql on the given transaction and returns the id
+func (db *MysqlAdapter) insert(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+
+	// Execute the sql using the transaction so that the id is read from the same connection
+	result, err := db.performExec(ctx, tx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
@@ -1,11 +1,13 @@
 package adapters
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
 	// psql driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // PostgresqlAdapter conforms to the query.Database interface
@@ -13,16 +15,18 @@ type PostgresqlAdapter struct {
 	*Adapter
 	options map[string]string
 	sqlDB   *sql.DB
-	debug   bool
+	tx      *sql.Tx
 }
 
 // Open this database with the given options
 // opts map keys:adapter, user, password, db, host, port, params (give extra parameters in the params option)
+// stmt_cache_size sets the number of prepared statements cached (default 100, 0 disables the cache)
+// in_chunk_size sets the most values in an IN list (default 10000), longer lists are bound as
+// one array with = ANY(), or split into chunks if in_array is false
 // Additional options available are detailed in the pq driver docs at
 // https://godoc.org/github.com/lib/pq
 func (db *PostgresqlAdapter) Open(opts map[string]string) error {
 
-	db.debug = false
 	db.options = map[string]string{
 		"adapter":  "postgres",
 		"user":     "",
@@ -33,10 +37,6 @@ func (db *PostgresqlAdapter) Open(opts map[string]string) error {
 		"params":   "sslmode=disable connect_timeout=60", // disable sslmode for localhost, set timeout
 	}
 
-	if opts["debug"] == "true" {
-		db.debug = true
-	}
-
 	// Merge options
 	for k, v := range opts {
 		db.options[k] = v
@@ -54,7 +54,7 @@ func (db *PostgresqlAdapter) Open(opts map[string]string) error {
 		db.options["params"])
 
 	var err error
-	db.sqlDB, err = sql.Open(db.options["adapter"], optionString)
+	db.sqlDB, db.Adapter, err = openSQLDB(db.options["adapter"], optionString, db.options)
 	if err != nil {
 		return err
 	}
@@ -65,10 +65,6 @@ func (db *PostgresqlAdapter) Open(opts map[string]string) error {
 		return err
 	}
 
-	if db.sqlDB != nil && db.debug {
-		fmt.Printf("Database %s opened using %s\n", db.options["db"], db.options["adapter"])
-	}
-
 	return nil
 
 }
@@ -80,10 +76,22 @@ func paramOrBlank(k, v string) string {
 	return ""
 }
 
+// OpenWithSQLDB uses the existing sqlDB given rather than opening a new connection,
+// sqlDB remains owned by the caller and is not closed on Close
+func (db *PostgresqlAdapter) OpenWithSQLDB(sqlDB *sql.DB, opts map[string]string) (err error) {
+	db.Adapter, db.options, err = borrowSQLDB(sqlDB, "postgres", opts)
+	if err != nil {
+		return err
+	}
+	db.sqlDB = sqlDB
+
+	return nil
+}
+
 // Close the database
 func (db *PostgresqlAdapter) Close() error {
 	if db.sqlDB != nil {
-		return db.sqlDB.Close()
+		return db.closeDB(db.sqlDB)
 	}
 	return nil
 }
@@ -93,14 +101,31 @@ func (db *PostgresqlAdapter) SQLDB() *sql.DB {
 	return db.sqlDB
 }
 
+// WithTx returns a copy of this adapter which executes statements on the given transaction
+func (db *PostgresqlAdapter) WithTx(tx *sql.Tx) Database {
+	txdb := *db
+	txdb.tx = tx
+	return &txdb
+}
+
 // Query executes query SQL - NB caller must call use defer rows.Close() with rows returned
 func (db *PostgresqlAdapter) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return db.performQuery(db.sqlDB, db.debug, query, args...)
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext executes query SQL with the given context - NB caller must call use defer rows.Close() with rows returned
+func (db *PostgresqlAdapter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.performQuery(ctx, db.executor(db.sqlDB, db.tx), query, args...)
 }
 
 // Exec - use this for non-select statements
 func (db *PostgresqlAdapter) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return db.performExec(db.sqlDB, db.debug, query, args...)
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext - use this for non-select statements with the given context
+func (db *PostgresqlAdapter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.performExec(ctx, db.executor(db.sqlDB, db.tx), query, args...)
 }
 
 // Placeholder returns the db placeholder
@@ -113,12 +138,53 @@ func (db *PostgresqlAdapter) InsertSQL(pk string) string {
 	return fmt.Sprintf("RETURNING %s", pk)
 }
 
+// IsRetryable reports whether the error is a serialization failure (40001) or deadlock (40P01)
+// which may succeed if the transaction is run again
+func (db *PostgresqlAdapter) IsRetryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch string(pqErr.Code) {
+		case "40001", "40P01":
+			return true
+		}
+	}
+	return false
+}
+
+// ArrayArg returns values as a postgres array for use with = ANY(?), for slices of basic types,
+// unless the in_array option is false
+func (db *PostgresqlAdapter) ArrayArg(values interface{}) (interface{}, bool) {
+	if db.options["in_array"] == "false" {
+		return nil, false
+	}
+	switch v := values.(type) {
+	case []int:
+		ints := make([]int64, len(v))
+		for i, n := range v {
+			ints[i] = int64(n)
+		}
+		return pq.Array(ints), true
+	case []int64, []float64, []bool, []string:
+		return pq.Array(v), true
+	}
+	return nil, false
+}
+
 // Insert a record with params and return the id
 func (db *PostgresqlAdapter) Insert(sql string, args ...interface{}) (id int64, err error) {
+	return db.InsertContext(context.Background(), sql, args...)
+}
+
+// InsertContext inserts a record with params using the given context and returns the id
+func (db *PostgresqlAdapter) InsertContext(ctx context.Context, sql string, args ...interface{}) (id int64, err error) {
 
 	// TODO - handle different types of id, not just int
 	// Execute the sql using db and retrieve new row id
-	row := db.sqlDB.QueryRow(sql, args...)
+	ex := db.executor(db.sqlDB, db.tx)
+	if ex == nil {
+		return 0, fmt.Errorf("No database available.")
+	}
+	row := ex.QueryRowContext(ctx, sql, args...)
 	err = row.Scan(&id)
 	return id, err
 }
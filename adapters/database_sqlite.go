@@ -1,38 +1,39 @@
 package adapters
 
-// FIXME: Sqlite drivers are broken compiling with cgo at present
-// therefore we don't use this adapter
-
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	// Unfortunately can't cross compile with sqlite support enabled -
-	// see https://github.com/mattn/go-sqlite3/issues/106
-	// For now for we just turn off sqlite as we don't use it in production...
-	// pure go version of sqlite, or ditch sqlite and find some other pure go simple db
-	// would be nice not to require a db at all for very simple usage
-	//_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	// Pure go sqlite driver, which does not require cgo so allows cross compilation
+	_ "modernc.org/sqlite"
 )
 
 // SqliteAdapter conforms to the query.Database interface
 type SqliteAdapter struct {
 	*Adapter
-	options map[string]string
-	sqlDB   *sql.DB
-	debug   bool
+	options   map[string]string
+	sqlDB     *sql.DB
+	tx        *sql.Tx
+	returning bool
 }
 
-// Open this database
+// Open this database with the given options
+// opts map keys:adapter, db (a file path or :memory:), journal_mode (e.g. WAL), busy_timeout (in ms)
+// stmt_cache_size sets the number of prepared statements cached (default 100, 0 disables the cache)
+// in_chunk_size sets the most values in an IN list (default 10000), longer lists are split into chunks
 func (db *SqliteAdapter) Open(opts map[string]string) error {
 
-	db.debug = false
 	db.options = map[string]string{
-		"adapter": "sqlite3",
-		"db":      "./tests/query_test.sqlite",
-	}
-
-	if opts["debug"] == "true" {
-		db.debug = true
+		"adapter":      "sqlite3",
+		"driver":       "sqlite",
+		"db":           "./tests/query_test.sqlite",
+		"journal_mode": "",
+		"busy_timeout": "5000",
 	}
 
 	for k, v := range opts {
@@ -40,13 +41,14 @@ func (db *SqliteAdapter) Open(opts map[string]string) error {
 	}
 
 	var err error
-	db.sqlDB, err = sql.Open(db.options["adapter"], db.options["db"])
+	db.sqlDB, db.Adapter, err = openSQLDB(db.options["driver"], db.dataSource(), db.options)
 	if err != nil {
 		return err
 	}
 
-	if db.sqlDB != nil && db.debug {
-		fmt.Printf("Database %s opened using %s\n", db.options["db"], db.options["adapter"])
+	// Each connection to an in memory database sees a different database, so use only one
+	if db.memory() {
+		db.sqlDB.SetMaxOpenConns(1)
 	}
 
 	// Call ping on the db to check it does actually exist!
@@ -55,14 +57,74 @@ func (db *SqliteAdapter) Open(opts map[string]string) error {
 		return err
 	}
 
-	return err
+	return db.checkVersion()
+
+}
+
+// OpenWithSQLDB uses the existing sqlDB given rather than opening a new connection,
+// sqlDB remains owned by the caller and is not closed on Close
+func (db *SqliteAdapter) OpenWithSQLDB(sqlDB *sql.DB, opts map[string]string) (err error) {
+	db.Adapter, db.options, err = borrowSQLDB(sqlDB, "sqlite3", opts)
+	if err != nil {
+		return err
+	}
+	db.sqlDB = sqlDB
+
+	return db.checkVersion()
+}
+
+// checkVersion uses RETURNING for inserts if this version of sqlite supports it (3.35 and later)
+func (db *SqliteAdapter) checkVersion() error {
+	var version string
+	err := db.sqlDB.QueryRow("select sqlite_version()").Scan(&version)
+	if err != nil {
+		return err
+	}
+	db.returning = versionAtLeast(version, 3, 35)
+	return nil
+}
+
+// dataSource returns the data source name for the driver, setting pragmas from options
+func (db *SqliteAdapter) dataSource() string {
+	params := url.Values{}
+	if db.options["busy_timeout"] != "" {
+		params.Add("_pragma", fmt.Sprintf("busy_timeout(%s)", db.options["busy_timeout"]))
+	}
+	if db.options["journal_mode"] != "" && !db.memory() {
+		params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", db.options["journal_mode"]))
+	}
+	if len(params) == 0 {
+		return db.options["db"]
+	}
+	return fmt.Sprintf("%s?%s", db.options["db"], params.Encode())
+}
+
+// memory returns true if this is an in memory database
+func (db *SqliteAdapter) memory() bool {
+	return db.options["db"] == ":memory:"
+}
 
+// versionAtLeast returns true if the version string given is at least major.minor
+func versionAtLeast(version string, major, minor int) bool {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return false
+	}
+	ma, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	mi, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return ma > major || (ma == major && mi >= minor)
 }
 
 // Close the database
 func (db *SqliteAdapter) Close() error {
 	if db.sqlDB != nil {
-		return db.sqlDB.Close()
+		return db.closeDB(db.sqlDB)
 	}
 	return nil
 }
@@ -72,21 +134,73 @@ func (db *SqliteAdapter) SQLDB() *sql.DB {
 	return db.sqlDB
 }
 
+// WithTx returns a copy of this adapter which executes statements on the given transaction
+func (db *SqliteAdapter) WithTx(tx *sql.Tx) Database {
+	txdb := *db
+	txdb.tx = tx
+	return &txdb
+}
+
 // Query execute Query SQL - NB caller must call use defer rows.Close() with rows returned
 func (db *SqliteAdapter) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return db.performQuery(db.sqlDB, db.debug, query, args...)
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext executes query SQL with the given context - NB caller must call use defer rows.Close() with rows returned
+func (db *SqliteAdapter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.performQuery(ctx, db.executor(db.sqlDB, db.tx), query, args...)
 }
 
 // Exec - use this for non-select statements
 func (db *SqliteAdapter) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return db.performExec(db.sqlDB, db.debug, query, args...)
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext - use this for non-select statements with the given context
+func (db *SqliteAdapter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.performExec(ctx, db.executor(db.sqlDB, db.tx), query, args...)
+}
+
+// TimeString - given a time, return a string representation the driver can parse back to a time
+func (db *SqliteAdapter) TimeString(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05.999999999-07:00")
+}
+
+// InsertSQL is extra SQL for end of insert statement (RETURNING if supported)
+func (db *SqliteAdapter) InsertSQL(pk string) string {
+	if db.returning {
+		return fmt.Sprintf("RETURNING %s", pk)
+	}
+	return ""
 }
 
 // Insert a record with params and return the id - psql behaves differently
 func (db *SqliteAdapter) Insert(query string, args ...interface{}) (id int64, err error) {
+	return db.InsertContext(context.Background(), query, args...)
+}
+
+// InsertContext inserts a record with params using the given context and returns the id
+func (db *SqliteAdapter) InsertContext(ctx context.Context, query string, args ...interface{}) (id int64, err error) {
+
+	// If the insert sql uses RETURNING, read the id from the row returned
+	if db.returning {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			if err = rows.Err(); err != nil {
+				return 0, err
+			}
+			return 0, sql.ErrNoRows
+		}
+		err = rows.Scan(&id)
+		return id, err
+	}
 
 	// Execute the sql using db
-	result, err := db.Exec(query, args...)
+	result, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
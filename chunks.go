@@ -0,0 +1,347 @@
+package query
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inChunkMarker stands in for the values of a long IN list in the where clause,
+// it is replaced with placeholders for each chunk of values when the query is executed
+const inChunkMarker = "/* query: chunked values */"
+
+// inChunk holds the values of an IN list too long to bind in one statement
+type inChunk struct {
+	col  string
+	size int
+
+	values []interface{}
+
+	// The index in the where args at which the values belong
+	argIndex int
+}
+
+// whereIn adds an IN or NOT IN clause for col. Lists longer than the adapter's chunk size
+// are bound as one array arg if the adapter supports it, or else split into chunks executed
+// as separate statements (NOT IN lists cannot be split).
+func (q *Query) whereIn(col string, not bool, values interface{}, args []interface{}) *Query {
+
+	// Repeated values in a long list would be selected by more than one chunk
+	size := q.db.adapter.InChunkSize()
+	if size > 0 && len(args) > size {
+		args = uniqueValues(args)
+	}
+
+	if size > 0 && len(args) > size {
+
+		if arg, ok := q.db.adapter.ArrayArg(values); ok {
+			if not {
+				return q.Where(fmt.Sprintf("NOT (%s = ANY(?))", col), arg)
+			}
+			return q.Where(fmt.Sprintf("%s = ANY(?)", col), arg)
+		}
+
+		if not {
+			q.err = fmt.Errorf("query: NOT IN list of %d values for %s exceeds the chunk size %d", len(args), col, size)
+			return q
+		}
+		if q.chunk != nil {
+			q.err = fmt.Errorf("query: IN list of %d values for %s exceeds the chunk size %d, and only one list may be split", len(args), col, size)
+			return q
+		}
+
+		q.chunk = &inChunk{col: col, size: size, values: args, argIndex: len(q.whereArgs)}
+		return q.Where(fmt.Sprintf("%s IN (%s)", col, inChunkMarker))
+	}
+
+	sql, args := inList{col: col, not: not, values: args}.build(noQuote)
+	return q.Where(sql, args...)
+}
+
+// chunks returns a copy of q for each chunk of its long IN list, or an error if
+// the query cannot be split into statements whose results may be merged.
+// Results may be merged for a limit, and for an order of plain columns which are sorted again once merged,
+// but updates and deletes may not be limited.
+func (q *Query) chunks(results bool) ([]*Query, error) {
+	c := q.chunk
+	_, sortable := orderKeys(q.order)
+	if q.offset != "" || q.group != "" || q.having != "" || q.orWhere ||
+		(results && q.order != "" && (!sortable || len(q.orderArgs) > 0)) || (!results && q.limit != "") {
+		return nil, fmt.Errorf("query: IN list of %d values for %s exceeds the chunk size %d, and cannot be split in a query with offset, group, having, OrWhere, an order by expression or a limit on %s", len(c.values), c.col, c.size, q.tablename)
+	}
+
+	var queries []*Query
+	for i := 0; i < len(c.values); i += c.size {
+		end := i + c.size
+		if end > len(c.values) {
+			end = len(c.values)
+		}
+		values := c.values[i:end]
+
+		cq := q.Copy()
+		cq.chunk = nil
+		placeholders := strings.TrimRight(strings.Repeat("?,", len(values)), ",")
+		cq.where = strings.Replace(cq.where, inChunkMarker, placeholders, 1)
+
+		var whereArgs []interface{}
+		whereArgs = append(whereArgs, cq.whereArgs[:c.argIndex]...)
+		whereArgs = append(whereArgs, values...)
+		cq.whereArgs = append(whereArgs, cq.whereArgs[c.argIndex:]...)
+
+		cq.reset()
+		queries = append(queries, cq)
+	}
+	return queries, nil
+}
+
+// chunkedResults executes the query for each chunk of its long IN list, merging the results
+// in order, and applying any limit to the merged results
+func (q *Query) chunkedResults() ([]Result, error) {
+	queries, err := q.chunks(true)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, _ := orderKeys(q.order)
+	limit := -1
+	if q.limit != "" {
+		fmt.Sscanf(q.limit, "LIMIT %d", &limit)
+	}
+
+	var results []Result
+	for _, cq := range queries {
+		r, err := cq.Results()
+		if err != nil {
+			return results, err
+		}
+		results = append(results, r...)
+
+		// Without an order any rows will do, so stop once we have enough
+		if len(keys) == 0 && limit >= 0 && len(results) >= limit {
+			return results[:limit], nil
+		}
+	}
+
+	// Each chunk is ordered and limited, so sort the merged rows and take the limit of those
+	err = sortResults(results, keys)
+	if err != nil {
+		return nil, err
+	}
+	if limit >= 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// uniqueValues returns values with repeated values removed, keeping the first of each
+func uniqueValues(values []interface{}) []interface{} {
+	seen := make(map[interface{}]bool, len(values))
+	unique := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if hashable(v) {
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+		}
+		unique = append(unique, v)
+	}
+	return unique
+}
+
+// orderKey is a column to sort merged results by
+type orderKey struct {
+	col  string
+	desc bool
+}
+
+// orderKeys returns the columns in an order of plain columns e.g. ORDER BY pages.id desc, name
+// or false if the order includes expressions. Table names and quotes are removed, as they are from result keys.
+func orderKeys(order string) ([]orderKey, bool) {
+	if order == "" {
+		return nil, true
+	}
+	var keys []orderKey
+	for _, part := range strings.Split(strings.TrimPrefix(order, "ORDER BY "), ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, false
+		}
+
+		var k orderKey
+		if len(fields) == 2 {
+			switch strings.ToLower(fields[1]) {
+			case "asc":
+			case "desc":
+				k.desc = true
+			default:
+				return nil, false
+			}
+		}
+
+		col := fields[0]
+		if i := strings.LastIndex(col, "."); i >= 0 {
+			col = col[i+1:]
+		}
+		k.col = strings.Trim(col, "\"`")
+		if k.col == "" {
+			return nil, false
+		}
+		for i := 0; i < len(k.col); i++ {
+			if !isIdentifier(k.col[i]) {
+				return nil, false
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, true
+}
+
+// sortResults sorts results by the order keys given, which must be among the columns selected.
+// Nulls sort first, and strings are compared bytewise rather than with the database collation.
+func sortResults(results []Result, keys []orderKey) error {
+	if len(keys) == 0 || len(results) == 0 {
+		return nil
+	}
+	for _, k := range keys {
+		if _, ok := results[0][k.col]; !ok {
+			return fmt.Errorf("query: cannot sort chunked results by %s, which is not selected", k.col)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, k := range keys {
+			c := compareValues(results[i][k.col], results[j][k.col])
+			if c != 0 {
+				return (c < 0) != k.desc
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// compareValues compares two values read from the database, returning -1, 0 or 1
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch av := a.(type) {
+	case int64:
+		if bv, ok := b.(int64); ok {
+			return cmp.Compare(av, bv)
+		}
+	case float64:
+		if bv, ok := b.(float64); ok {
+			return cmp.Compare(av, bv)
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return cmp.Compare(av, bv)
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			return av.Compare(bv)
+		}
+	case bool:
+		if bv, ok := b.(bool); ok && av != bv {
+			if bv {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	}
+	return cmp.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// chunkedCount sums the count for each chunk of its long IN list.
+// Queries with joins are rejected, as a row joined to values in two chunks would be counted twice.
+func (q *Query) chunkedCount() (int64, error) {
+	if q.join != "" {
+		c := q.chunk
+		return 0, fmt.Errorf("query: IN list of %d values for %s exceeds the chunk size %d, and cannot be split to count a query with joins on %s", len(c.values), c.col, c.size, q.tablename)
+	}
+	queries, err := q.chunks(false)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, cq := range queries {
+		n, err := cq.count()
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// chunkedResult executes the statement for each chunk of its long IN list, summing the rows affected.
+// The chunks are executed in one transaction, unless the query is already within one,
+// so that if one chunk fails none are applied.
+func (q *Query) chunkedResult(op string) (sql.Result, error) {
+	queries, err := q.chunks(false)
+	if err != nil {
+		return nil, err
+	}
+	if q.db.inTx {
+		return execChunks(queries, op)
+	}
+
+	var result sql.Result
+	err = q.db.TransactionContext(q.context(), nil, func(tx *Tx) error {
+		for _, cq := range queries {
+			cq.db = tx.db
+		}
+		r, err := execChunks(queries, op)
+		if err != nil {
+			return err
+		}
+		result = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// execChunks executes the statement for each chunk in turn, summing the rows affected
+func execChunks(queries []*Query, op string) (sql.Result, error) {
+	var result chunkedResult
+	for _, cq := range queries {
+		r, err := cq.result(op)
+		if err != nil {
+			return result, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return result, err
+		}
+		result.rowsAffected += n
+	}
+	return result, nil
+}
+
+// chunkedResult is the merged result of chunked statements
+type chunkedResult struct {
+	rowsAffected int64
+}
+
+// LastInsertId is not available for chunked statements
+func (r chunkedResult) LastInsertId() (int64, error) {
+	return 0, fmt.Errorf("query: last insert id is not available for chunked statements")
+}
+
+// RowsAffected returns the total rows affected by the chunked statements
+func (r chunkedResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
@@ -0,0 +1,221 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CollectedStatement records a statement seen by a Collector
+type CollectedStatement struct {
+	Operation   string
+	Table       string
+	SQL         string
+	Fingerprint string
+	Args        []interface{}
+	Duration    time.Duration
+	Caller      string
+	Err         error
+}
+
+// Collector records the statements executed within a scope such as one http request,
+// for development toolbars or assertions in tests. Attach it to a context with
+// WithCollector to record statements executed with that context, or add it to
+// a database with AddHook to record every statement on the database.
+type Collector struct {
+	mu         sync.Mutex
+	statements []CollectedStatement
+
+	// The different single id args seen for each call site, in the order first seen
+	sites []callSite
+	ids   map[callSite]map[interface{}]bool
+}
+
+// callSite identifies a statement executed from one place in the code
+type callSite struct {
+	fingerprint, caller string
+}
+
+// NewCollector returns an empty collector
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// collectorKey is the context key for collectors
+type collectorKey struct{}
+
+// WithCollector returns a copy of ctx which records statements executed with it in c
+func WithCollector(ctx context.Context, c *Collector) context.Context {
+	return context.WithValue(ctx, collectorKey{}, c)
+}
+
+// CollectorFromContext returns the collector attached to ctx, or nil if none
+func CollectorFromContext(ctx context.Context) *Collector {
+	c, _ := ctx.Value(collectorKey{}).(*Collector)
+	return c
+}
+
+// Before conforms to Hook, and does nothing
+func (c *Collector) Before(ctx context.Context, e *Event) context.Context {
+	return ctx
+}
+
+// After records the statement
+func (c *Collector) After(ctx context.Context, e *Event) {
+	c.record(e)
+}
+
+// record adds the statement described by e, returning the statement recorded and,
+// if it has a single id arg not seen before from its call site, the count of ids seen there
+func (c *Collector) record(e *Event) (CollectedStatement, int) {
+	s := CollectedStatement{
+		Operation:   e.Operation,
+		Table:       e.Table,
+		SQL:         e.SQL,
+		Fingerprint: Fingerprint(e.SQL),
+		Args:        e.Args,
+		Duration:    e.Duration,
+		Caller:      caller(),
+		Err:         e.Err,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = append(c.statements, s)
+
+	if len(s.Args) != 1 || !hashable(s.Args[0]) {
+		return s, 0
+	}
+	k := callSite{s.Fingerprint, s.Caller}
+	if c.ids == nil {
+		c.ids = make(map[callSite]map[interface{}]bool)
+	}
+	if c.ids[k] == nil {
+		c.ids[k] = make(map[interface{}]bool)
+		c.sites = append(c.sites, k)
+	}
+	if c.ids[k][s.Args[0]] {
+		return s, 0
+	}
+	c.ids[k][s.Args[0]] = true
+	return s, len(c.ids[k])
+}
+
+// Statements returns a copy of the statements recorded, in the order executed
+func (c *Collector) Statements() []CollectedStatement {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CollectedStatement(nil), c.statements...)
+}
+
+// Count returns the number of statements recorded
+func (c *Collector) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.statements)
+}
+
+// Duration returns the total duration of the statements recorded
+func (c *Collector) Duration() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var d time.Duration
+	for _, s := range c.statements {
+		d += s.Duration
+	}
+	return d
+}
+
+// Reset clears the statements recorded
+func (c *Collector) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = nil
+	c.sites = nil
+	c.ids = nil
+}
+
+// DefaultNPlusOneThreshold is the number of single id lookups from one call site reported as N+1
+const DefaultNPlusOneThreshold = 5
+
+// NPlusOne describes a statement executed repeatedly from one call site with differing single id args,
+// usually a lookup within a loop which could be replaced by one query using WhereIn
+type NPlusOne struct {
+	Fingerprint string
+	Caller      string
+	Count       int
+}
+
+// String returns a warning describing the N+1 query
+func (n NPlusOne) String() string {
+	return fmt.Sprintf("query: possible N+1 query at %s - %q executed %d times with different ids, consider loading them at once with WhereIn", n.Caller, n.Fingerprint, n.Count)
+}
+
+// NPlusOne returns the N+1 queries recorded - statements with the same fingerprint and
+// call site executed with at least threshold different single args
+func (c *Collector) NPlusOne(threshold int) []NPlusOne {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found []NPlusOne
+	for _, k := range c.sites {
+		if len(c.ids[k]) >= threshold {
+			found = append(found, NPlusOne{Fingerprint: k.fingerprint, Caller: k.caller, Count: len(c.ids[k])})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Count > found[j].Count })
+	return found
+}
+
+// nPlusOneConfig holds the N+1 query threshold for a database
+type nPlusOneConfig struct {
+	mu sync.RWMutex
+
+	// N+1 queries in a collector scope are reported once they reach this many ids, 0 disables
+	threshold int
+}
+
+// SetNPlusOneThreshold enables development mode detection of N+1 queries on this database.
+// When a statement executed with a Collector in its context (see WithCollector) is
+// repeated from the same call site with threshold different single id args, a warning
+// naming the call site is logged. A threshold of 0 disables detection.
+func (db *DB) SetNPlusOneThreshold(threshold int) {
+	db.nPlusOne.mu.Lock()
+	db.nPlusOne.threshold = threshold
+	db.nPlusOne.mu.Unlock()
+}
+
+// SetNPlusOneThreshold enables N+1 query detection on the default database
+func SetNPlusOneThreshold(threshold int) {
+	database.SetNPlusOneThreshold(threshold)
+}
+
+// collect records the statement described by e in the collector c,
+// and logs a warning if its id takes its call site to the N+1 threshold, so that each site is reported once
+func (db *DB) collect(ctx context.Context, c *Collector, e *Event) {
+	s, ids := c.record(e)
+
+	db.nPlusOne.mu.RLock()
+	threshold := db.nPlusOne.threshold
+	db.nPlusOne.mu.RUnlock()
+
+	if threshold > 0 && ids == threshold {
+		n := NPlusOne{Fingerprint: s.Fingerprint, Caller: s.Caller, Count: ids}
+		db.Logger().LogAttrs(ctx, slog.LevelWarn, n.String(),
+			slog.String("caller", n.Caller),
+			slog.String("fingerprint", n.Fingerprint),
+			slog.Int("count", n.Count),
+		)
+	}
+}
+
+// hashable returns true if v may be used as a map key
+func hashable(v interface{}) bool {
+	switch v.(type) {
+	case nil, bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, time.Time:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Condition is a composable sql condition built with Eq, In, And, Or etc,
+// which is added to a query with WhereExpr. Columns are quoted by the
+// query's adapter and values are passed as args.
+type Condition interface {
+	// build returns the sql for the condition with ? placeholders, and the args in order
+	build(quote func(string) string) (string, []interface{})
+}
+
+// comparison compares a column with a value using op
+type comparison struct {
+	col   string
+	op    string
+	value interface{}
+}
+
+func (c comparison) build(quote func(string) string) (string, []interface{}) {
+	return fmt.Sprintf("%s %s ?", quoteColumn(quote, c.col), c.op), []interface{}{c.value}
+}
+
+// Eq returns the condition col = value, or col IS NULL if value is nil
+func Eq(col string, value interface{}) Condition {
+	if value == nil {
+		return IsNull(col)
+	}
+	return comparison{col: col, op: "=", value: value}
+}
+
+// Neq returns the condition col <> value, or col IS NOT NULL if value is nil
+func Neq(col string, value interface{}) Condition {
+	if value == nil {
+		return IsNotNull(col)
+	}
+	return comparison{col: col, op: "<>", value: value}
+}
+
+// Gt returns the condition col > value
+func Gt(col string, value interface{}) Condition {
+	return comparison{col: col, op: ">", value: value}
+}
+
+// Gte returns the condition col >= value
+func Gte(col string, value interface{}) Condition {
+	return comparison{col: col, op: ">=", value: value}
+}
+
+// Lt returns the condition col < value
+func Lt(col string, value interface{}) Condition {
+	return comparison{col: col, op: "<", value: value}
+}
+
+// Lte returns the condition col <= value
+func Lte(col string, value interface{}) Condition {
+	return comparison{col: col, op: "<=", value: value}
+}
+
+// Like returns the condition col LIKE pattern
+func Like(col string, pattern string) Condition {
+	return comparison{col: col, op: "LIKE", value: pattern}
+}
+
+// inList tests a column against a list of values
+type inList struct {
+	col    string
+	not    bool
+	values []interface{}
+}
+
+func (c inList) build(quote func(string) string) (string, []interface{}) {
+	// An empty list matches no rows (or every row for NOT IN)
+	if len(c.values) == 0 {
+		if c.not {
+			return "1=1", nil
+		}
+		return "1=0", nil
+	}
+	op := "IN"
+	if c.not {
+		op = "NOT IN"
+	}
+	placeholders := strings.TrimRight(strings.Repeat("?,", len(c.values)), ",")
+	return fmt.Sprintf("%s %s (%s)", quoteColumn(quote, c.col), op, placeholders), c.values
+}
+
+// In returns the condition col IN (values), an empty list of values matches no rows
+func In[T any](col string, values []T) Condition {
+	return inList{col: col, values: interfaceValues(values)}
+}
+
+// NotIn returns the condition col NOT IN (values), an empty list of values matches every row
+func NotIn[T any](col string, values []T) Condition {
+	return inList{col: col, not: true, values: interfaceValues(values)}
+}
+
+// betweenRange tests a column is within a range
+type betweenRange struct {
+	col    string
+	lo, hi interface{}
+}
+
+func (c betweenRange) build(quote func(string) string) (string, []interface{}) {
+	return fmt.Sprintf("%s BETWEEN ? AND ?", quoteColumn(quote, c.col)), []interface{}{c.lo, c.hi}
+}
+
+// Between returns the condition col BETWEEN lo AND hi
+func Between(col string, lo, hi interface{}) Condition {
+	return betweenRange{col: col, lo: lo, hi: hi}
+}
+
+// nullCheck tests whether a column is null
+type nullCheck struct {
+	col string
+	not bool
+}
+
+func (c nullCheck) build(quote func(string) string) (string, []interface{}) {
+	if c.not {
+		return fmt.Sprintf("%s IS NOT NULL", quoteColumn(quote, c.col)), nil
+	}
+	return fmt.Sprintf("%s IS NULL", quoteColumn(quote, c.col)), nil
+}
+
+// IsNull returns the condition col IS NULL
+func IsNull(col string) Condition {
+	return nullCheck{col: col}
+}
+
+// IsNotNull returns the condition col IS NOT NULL
+func IsNotNull(col string) Condition {
+	return nullCheck{col: col, not: true}
+}
+
+// negation negates a condition
+type negation struct {
+	cond Condition
+}
+
+func (c negation) build(quote func(string) string) (string, []interface{}) {
+	sql, args := c.cond.build(quote)
+	return fmt.Sprintf("NOT (%s)", sql), args
+}
+
+// Not returns the condition NOT (cond)
+func Not(cond Condition) Condition {
+	return negation{cond: cond}
+}
+
+// conditionGroup joins conditions with AND or OR in parentheses
+type conditionGroup struct {
+	op    string
+	conds []Condition
+}
+
+func (c conditionGroup) build(quote func(string) string) (string, []interface{}) {
+	// An empty AND is true, and an empty OR is false
+	if len(c.conds) == 0 {
+		if c.op == "AND" {
+			return "1=1", nil
+		}
+		return "1=0", nil
+	}
+
+	var parts []string
+	var args []interface{}
+	for _, cond := range c.conds {
+		sql, a := cond.build(quote)
+		parts = append(parts, sql)
+		args = append(args, a...)
+	}
+	if len(parts) == 1 {
+		return parts[0], args
+	}
+	return fmt.Sprintf("(%s)", strings.Join(parts, " "+c.op+" ")), args
+}
+
+// And returns the condition (a AND b ...), with no conditions it is always true
+func And(conds ...Condition) Condition {
+	return conditionGroup{op: "AND", conds: conds}
+}
+
+// Or returns the condition (a OR b ...), with no conditions it is always false
+func Or(conds ...Condition) Condition {
+	return conditionGroup{op: "OR", conds: conds}
+}
+
+// rawCondition is a condition given as sql
+type rawCondition struct {
+	sql  string
+	args []interface{}
+}
+
+func (c rawCondition) build(quote func(string) string) (string, []interface{}) {
+	return fmt.Sprintf("(%s)", c.sql), c.args
+}
+
+// Raw returns a condition with the sql given, using ? placeholders for args,
+// for conditions which cannot be built with the other functions
+func Raw(sql string, args ...interface{}) Condition {
+	return rawCondition{sql: sql, args: args}
+}
+
+// WhereExpr adds the condition to the WHERE clause, as Where does
+func (q *Query) WhereExpr(cond Condition) *Query {
+	sql, args := cond.build(q.db.adapter.QuoteField)
+	return q.Where(sql, args...)
+}
+
+// quoteColumn quotes each part of a column name e.g. pages.id
+func quoteColumn(quote func(string) string, col string) string {
+	parts := strings.Split(col, ".")
+	for i, p := range parts {
+		if p != "*" {
+			parts[i] = quote(p)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// interfaceValues converts a slice of values to a slice of interface{}
+func interfaceValues[T any](values []T) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
@@ -1,17 +1,217 @@
 package query
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/fragmenta/query/adapters"
 )
 
-// database is the package global db  - this reference is not exported outside the package.
-var database adapters.Database
+// DB is a handle on a database, which owns the adapter used to talk to it.
+// Several handles may be open at once, each returning queries bound to it.
+// The pointer fields below are shared with the handle's transactions.
+type DB struct {
+	adapter adapters.Database
 
-// OpenDatabase opens the database with the given options
+	// Whether the adapter executes statements on a transaction begun with Begin
+	inTx bool
+
+	// Hooks called around every statement
+	hooks *hooks
+
+	// Logger for statements and diagnostics
+	log *logConfig
+
+	// Statement stats by fingerprint
+	stats *stats
+
+	// Metrics statements are reported to
+	metrics *metricsConfig
+
+	// Rows tracked until closed in debug mode
+	leaks *rowsTracker
+
+	// N+1 query detection for statements collected
+	nPlusOne *nPlusOneConfig
+}
+
+// adapterFactories holds the adapters available to Open by name
+var (
+	adaptersMu       sync.RWMutex
+	adapterFactories = make(map[string]func() adapters.Database)
+)
+
+func init() {
+	RegisterAdapter("sqlite3", func() adapters.Database { return &adapters.SqliteAdapter{} })
+	RegisterAdapter("mysql", func() adapters.Database { return &adapters.MysqlAdapter{} })
+	RegisterAdapter("postgres", func() adapters.Database { return &adapters.PostgresqlAdapter{} })
+}
+
+// RegisterAdapter makes an adapter available to Open under the name given,
+// factory is called to create a new adapter each time a database is opened.
+// If RegisterAdapter is called twice with the same name or factory is nil, it panics.
+func RegisterAdapter(name string, factory func() adapters.Database) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+
+	if factory == nil {
+		panic("query: RegisterAdapter factory is nil")
+	}
+	if _, dup := adapterFactories[name]; dup {
+		panic("query: RegisterAdapter called twice for adapter " + name)
+	}
+	adapterFactories[name] = factory
+}
+
+// Adapters returns a sorted list of the names of registered adapters
+func Adapters() []string {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+
+	var names []string
+	for name := range adapterFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// database is the package global default handle, used by the package level functions.
+// this reference is not exported outside the package.
+var database *DB
+
+// Open opens a new database handle with the given options
+// opts["adapter"] selects the adapter by the name it was registered with
+func Open(opts map[string]string) (*DB, error) {
+
+	adaptersMu.RLock()
+	factory := adapterFactories[opts["adapter"]]
+	adaptersMu.RUnlock()
+
+	if factory == nil {
+		return nil, fmt.Errorf("query: database adapter not recognised - %s", opts)
+	}
+
+	return OpenAdapter(factory(), opts)
+}
+
+// OpenWithSQLDB opens a new database handle using an existing sql.DB connection pool,
+// with the SQL dialect of the adapter registered as dialect (e.g. postgres, mysql or sqlite3).
+// No new connection is opened, and sqlDB remains owned by the caller, so it is not closed on Close.
+func OpenWithSQLDB(dialect string, sqlDB *sql.DB) (*DB, error) {
+
+	adaptersMu.RLock()
+	factory := adapterFactories[dialect]
+	adaptersMu.RUnlock()
+
+	if factory == nil {
+		return nil, fmt.Errorf("query: database adapter not recognised - %s", dialect)
+	}
+
+	adapter := factory()
+	opts := map[string]string{"adapter": dialect}
+	err := adapter.OpenWithSQLDB(sqlDB, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDB(adapter, opts), nil
+}
+
+// OpenAdapter opens a new database handle using the adapter given, with the given options
+// This allows use of adapters not known to Open, such as adapters.FakeAdapter in tests
+func OpenAdapter(adapter adapters.Database, opts map[string]string) (*DB, error) {
+
+	// Ask the db adapter to open
+	err := adapter.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDB(adapter, opts), nil
+}
+
+// newDB returns a handle using the given adapter,
+// statements are logged to stdout if the debug option is true
+func newDB(adapter adapters.Database, opts map[string]string) *DB {
+	db := &DB{adapter: adapter, hooks: &hooks{}, stats: newStats(), metrics: &metricsConfig{}, leaks: &rowsTracker{}, nPlusOne: &nPlusOneConfig{}}
+	name := opts["adapter"]
+	if name == "" {
+		name = db.String()
+	}
+	db.log = newLogConfig(name, opts["debug"] == "true")
+	adapter.SetLogger(db.log.logger.With("adapter", db.log.adapter))
+	db.log.logger.Debug("query: database opened", "adapter", db.log.adapter, "db", opts["db"])
+	return db
+}
+
+// Close closes the database handle
+func (db *DB) Close() error {
+	db.reportLeakedRows()
+	return db.adapter.Close()
+}
+
+// Adapter returns the database adapter used by this handle
+func (db *DB) Adapter() adapters.Database {
+	return db.adapter
+}
+
+// New builds a new Query bound to this database, given the table and primary key
+func (db *DB) New(t string, pk string) *Query {
+	return &Query{
+		db:         db,
+		tablename:  t,
+		primarykey: pk,
+	}
+}
+
+// Exec the given sql and args against the database directly
+// Returning sql.Result (NB not rows)
+func (db *DB) Exec(sql string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), sql, args...)
+}
+
+// ExecContext executes the given sql and args against the database using the given context
+func (db *DB) ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	return db.exec(ctx, "Exec", "", sql, args)
+}
+
+// Rows executes the given sql and args against the database directly
+// Returning sql.Rows
+func (db *DB) Rows(sql string, args ...interface{}) (*sql.Rows, error) {
+	return db.RowsContext(context.Background(), sql, args...)
+}
+
+// RowsContext executes the given sql and args against the database using the given context
+func (db *DB) RowsContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return db.query(ctx, "Rows", "", sql, args)
+}
+
+// SetMaxOpenConns sets the maximum number of open connections
+func (db *DB) SetMaxOpenConns(max int) {
+	db.adapter.SQLDB().SetMaxOpenConns(max)
+}
+
+// StmtCacheStats returns usage statistics for the adapter's prepared statement cache
+func (db *DB) StmtCacheStats() adapters.StmtCacheStats {
+	return db.adapter.StmtCacheStats()
+}
+
+// TimeString returns a string formatted as a time for this db
+func (db *DB) TimeString(t time.Time) string {
+	return db.adapter.TimeString(t)
+}
+
+// String returns a description of the handle for use in errors
+func (db *DB) String() string {
+	return fmt.Sprintf("%T", db.adapter)
+}
+
+// OpenDatabase opens the default database with the given options
 func OpenDatabase(opts map[string]string) error {
 
 	// If we already have a db, return it
@@ -19,24 +219,30 @@ func OpenDatabase(opts map[string]string) error {
 		return fmt.Errorf("query: database already open - %s", database)
 	}
 
+	db, err := Open(opts)
+	if err != nil {
+		return err
+	}
+
 	// Assign the db global in query package
-	switch opts["adapter"] {
-	case "sqlite3":
-		database = &adapters.SqliteAdapter{}
-	case "mysql":
-		database = &adapters.MysqlAdapter{}
-	case "postgres":
-		database = &adapters.PostgresqlAdapter{}
-	default:
-		database = nil // fail
+	database = db
+	return nil
+}
+
+// OpenDatabaseAdapter opens the default database using the adapter given, with the given options
+func OpenDatabaseAdapter(adapter adapters.Database, opts map[string]string) error {
+
+	if database != nil {
+		return fmt.Errorf("query: database already open - %s", database)
 	}
 
-	if database == nil {
-		return fmt.Errorf("query: database adapter not recognised - %s", opts)
+	db, err := OpenAdapter(adapter, opts)
+	if err != nil {
+		return err
 	}
 
-	// Ask the db adapter to open
-	return database.Open(opts)
+	database = db
+	return nil
 }
 
 // CloseDatabase closes the database opened by OpenDatabase
@@ -52,7 +258,7 @@ func CloseDatabase() error {
 
 // SetMaxOpenConns sets the maximum number of open connections
 func SetMaxOpenConns(max int) {
-	database.SQLDB().SetMaxOpenConns(max)
+	database.SetMaxOpenConns(max)
 }
 
 // QuerySQL executes the given sql Query against our database, with arbitrary args
@@ -60,8 +266,7 @@ func QuerySQL(query string, args ...interface{}) (*sql.Rows, error) {
 	if database == nil {
 		return nil, fmt.Errorf("query: QuerySQL called with nil database")
 	}
-	results, err := database.Query(query, args...)
-	return results, err
+	return database.Rows(query, args...)
 }
 
 // ExecSQL executes the given sql against our database with arbitrary args
@@ -70,8 +275,7 @@ func ExecSQL(query string, args ...interface{}) (sql.Result, error) {
 	if database == nil {
 		return nil, fmt.Errorf("query: ExecSQL called with nil database")
 	}
-	results, err := database.Exec(query, args...)
-	return results, err
+	return database.Exec(query, args...)
 }
 
 // TimeString returns a string formatted as a time for this db
@@ -0,0 +1,178 @@
+package query
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// Event describes a statement executed against the database, and is passed to hooks
+type Event struct {
+	// The operation which issued the statement e.g. Count, Insert, Results, Exec
+	Operation string
+
+	// The table queried, blank for raw statements
+	Table string
+
+	// The SQL and args executed
+	SQL  string
+	Args []interface{}
+
+	// Start time and duration of execution, set before After is called
+	Start    time.Time
+	Duration time.Duration
+
+	// Rows affected by exec statements or inserts, or rows read by Results, -1 if unknown
+	RowsAffected int64
+
+	// The error returned by the database, if any
+	Err error
+}
+
+// Hook is called before and after every statement executed on a database.
+// Before may return a new context, which is used to execute the statement and passed to After.
+type Hook interface {
+	Before(ctx context.Context, e *Event) context.Context
+	After(ctx context.Context, e *Event)
+}
+
+// HookFuncs adapts a pair of functions to the Hook interface, either may be nil
+type HookFuncs struct {
+	BeforeFunc func(ctx context.Context, e *Event) context.Context
+	AfterFunc  func(ctx context.Context, e *Event)
+}
+
+// Before calls BeforeFunc if set
+func (h HookFuncs) Before(ctx context.Context, e *Event) context.Context {
+	if h.BeforeFunc != nil {
+		return h.BeforeFunc(ctx, e)
+	}
+	return ctx
+}
+
+// After calls AfterFunc if set
+func (h HookFuncs) After(ctx context.Context, e *Event) {
+	if h.AfterFunc != nil {
+		h.AfterFunc(ctx, e)
+	}
+}
+
+// hooks is a chain of hooks for a database
+type hooks struct {
+	mu    sync.RWMutex
+	chain []Hook
+}
+
+// AddHook adds a hook to the chain of hooks called for every statement on this database.
+// Before is called on hooks in the order they were added, and After in reverse order.
+func (db *DB) AddHook(h Hook) {
+	db.hooks.mu.Lock()
+	defer db.hooks.mu.Unlock()
+	db.hooks.chain = append(db.hooks.chain, h)
+}
+
+// AddHook adds a hook to the default database
+func AddHook(h Hook) {
+	database.AddHook(h)
+}
+
+// before calls Before on each hook in order, returning the chain used and the resulting context
+func (h *hooks) before(ctx context.Context, e *Event) (context.Context, []Hook) {
+	h.mu.RLock()
+	chain := h.chain
+	h.mu.RUnlock()
+
+	for _, hook := range chain {
+		ctx = hook.Before(ctx, e)
+	}
+	e.Start = time.Now()
+	return ctx, chain
+}
+
+// after calls After on each hook in reverse order
+func (h *hooks) after(ctx context.Context, e *Event, chain []Hook) {
+	e.Duration = time.Since(e.Start)
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].After(ctx, e)
+	}
+}
+
+// exec executes a statement with no rows returned, calling hooks around it
+func (db *DB) exec(ctx context.Context, op, table, query string, args []interface{}) (sql.Result, error) {
+	e := &Event{Operation: op, Table: table, SQL: query, Args: args, RowsAffected: -1}
+	ctx, chain := db.hooks.before(ctx, e)
+
+	result, err := db.adapter.ExecContext(ctx, query, args...)
+	if err == nil {
+		if n, rerr := result.RowsAffected(); rerr == nil {
+			e.RowsAffected = n
+		}
+	}
+
+	e.Err = err
+	db.after(ctx, e, chain)
+	return result, err
+}
+
+// query executes a statement returning rows, calling hooks around it
+func (db *DB) query(ctx context.Context, op, table, query string, args []interface{}) (*sql.Rows, error) {
+	e := &Event{Operation: op, Table: table, SQL: query, Args: args, RowsAffected: -1}
+	ctx, chain := db.hooks.before(ctx, e)
+
+	rows, err := db.adapter.QueryContext(ctx, query, args...)
+	if err == nil {
+		db.trackRows(rows, query)
+	}
+
+	e.Err = err
+	db.after(ctx, e, chain)
+	return rows, err
+}
+
+// queryRows executes a statement returning rows and reads them with read, calling hooks around both
+// so that the number of rows read is passed to hooks. The rows are closed before returning.
+func (db *DB) queryRows(ctx context.Context, op, table, query string, args []interface{}, read func(rows *sql.Rows) (int, error)) error {
+	e := &Event{Operation: op, Table: table, SQL: query, Args: args, RowsAffected: -1}
+	ctx, chain := db.hooks.before(ctx, e)
+
+	rows, err := db.adapter.QueryContext(ctx, query, args...)
+	if err == nil {
+		var n int
+		n, err = read(rows)
+		rows.Close()
+		if err == nil {
+			e.RowsAffected = int64(n)
+		}
+	}
+
+	e.Err = err
+	db.after(ctx, e, chain)
+	return err
+}
+
+// insert executes an insert statement returning the new id, calling hooks around it
+func (db *DB) insert(ctx context.Context, op, table, query string, args []interface{}) (int64, error) {
+	e := &Event{Operation: op, Table: table, SQL: query, Args: args, RowsAffected: -1}
+	ctx, chain := db.hooks.before(ctx, e)
+
+	id, err := db.adapter.InsertContext(ctx, query, args...)
+	if err == nil {
+		e.RowsAffected = 1
+	}
+
+	e.Err = err
+	db.after(ctx, e, chain)
+	return id, err
+}
+
+// after calls hooks after a statement, then logs it and records it in the stats, metrics and any collector in ctx
+func (db *DB) after(ctx context.Context, e *Event, chain []Hook) {
+	db.hooks.after(ctx, e, chain)
+	db.logStatement(ctx, e)
+	db.stats.record(e)
+	db.observeStatement(e)
+	if c := CollectorFromContext(ctx); c != nil {
+		db.collect(ctx, c, e)
+	}
+}
@@ -0,0 +1,122 @@
+package query
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OpenRows describes rows returned by Rows which have not been closed
+type OpenRows struct {
+	SQL     string
+	Stack   string
+	Created time.Time
+}
+
+// rowsTracker tracks rows returned by a database until they are closed
+type rowsTracker struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	open    map[*sql.Rows]*OpenRows
+}
+
+// SetRowsLeakTimeout enables debug tracking of the rows returned by Query.Rows and Rows on this database.
+// Rows still open after timeout are logged at error level with the stack which created them
+// and the pool stats, as are any still open when the database is closed.
+// A timeout of 0 disables tracking. Tracking records a stack for every query, so is not intended for production.
+func (db *DB) SetRowsLeakTimeout(timeout time.Duration) {
+	db.leaks.mu.Lock()
+	defer db.leaks.mu.Unlock()
+	db.leaks.timeout = timeout
+	if timeout == 0 {
+		db.leaks.open = nil
+	}
+}
+
+// OpenRows returns the tracked rows which have not yet been closed, oldest first
+func (db *DB) OpenRows() []OpenRows {
+	db.leaks.mu.Lock()
+	defer db.leaks.mu.Unlock()
+
+	var open []OpenRows
+	for rows, r := range db.leaks.open {
+		if rowsClosed(rows) {
+			delete(db.leaks.open, rows)
+			continue
+		}
+		open = append(open, *r)
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].Created.Before(open[j].Created) })
+	return open
+}
+
+// SetRowsLeakTimeout enables tracking of rows on the default database
+func SetRowsLeakTimeout(timeout time.Duration) {
+	database.SetRowsLeakTimeout(timeout)
+}
+
+// trackRows tracks rows returned for query if tracking is enabled
+func (db *DB) trackRows(rows *sql.Rows, query string) {
+	db.leaks.mu.Lock()
+	defer db.leaks.mu.Unlock()
+
+	if db.leaks.timeout == 0 {
+		return
+	}
+	if db.leaks.open == nil {
+		db.leaks.open = make(map[*sql.Rows]*OpenRows)
+	}
+
+	r := &OpenRows{SQL: query, Stack: string(debug.Stack()), Created: time.Now()}
+	db.leaks.open[rows] = r
+
+	time.AfterFunc(db.leaks.timeout, func() {
+		db.leaks.mu.Lock()
+		tracked := db.leaks.open[rows] == r
+		closed := rowsClosed(rows)
+		if tracked && closed {
+			delete(db.leaks.open, rows)
+		}
+		db.leaks.mu.Unlock()
+
+		if tracked && !closed {
+			db.reportOpenRows("query: rows not closed after timeout", *r)
+		}
+	})
+}
+
+// reportLeakedRows reports any tracked rows which are still open, called when the database is closed
+func (db *DB) reportLeakedRows() {
+	for _, r := range db.OpenRows() {
+		db.reportOpenRows("query: rows not closed before database closed", r)
+	}
+}
+
+// reportOpenRows logs rows left open with pool diagnostics
+func (db *DB) reportOpenRows(msg string, r OpenRows) {
+	stats := db.PoolStats()
+	attrs := []slog.Attr{
+		slog.String("sql", r.SQL),
+		slog.Duration("age", time.Since(r.Created)),
+		slog.String("stack", r.Stack),
+		slog.Int("pool_open", stats.OpenConnections),
+		slog.Int("pool_in_use", stats.InUse),
+		slog.Int("pool_idle", stats.Idle),
+		slog.Int64("pool_wait_count", stats.WaitCount),
+		slog.Duration("pool_wait_duration", stats.WaitDuration),
+	}
+	if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections {
+		attrs = append(attrs, slog.Bool("pool_exhausted", true))
+	}
+	db.Logger().LogAttrs(context.Background(), slog.LevelError, msg, attrs...)
+}
+
+// rowsClosed returns true if rows have been closed, Columns returns an error once rows are closed
+func rowsClosed(rows *sql.Rows) bool {
+	_, err := rows.Columns()
+	return err != nil
+}
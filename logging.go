@@ -0,0 +1,102 @@
+package query
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// logConfig holds the logger for a database
+type logConfig struct {
+	mu      sync.RWMutex
+	logger  *slog.Logger
+	level   slog.Level
+	adapter string
+}
+
+// newLogConfig returns the default log config for an adapter - statements are logged
+// to stdout at debug level if debug is set, otherwise nothing is written.
+func newLogConfig(adapter string, debug bool) *logConfig {
+	lc := &logConfig{
+		adapter: adapter,
+		level:   slog.LevelDebug,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if debug || Debug {
+		lc.logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	return lc
+}
+
+// SetLogger sets the logger used for statements and diagnostic output on this database,
+// if logger is nil output is discarded.
+func (db *DB) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	db.log.mu.Lock()
+	db.log.logger = logger
+	db.log.mu.Unlock()
+	db.adapter.SetLogger(logger.With("adapter", db.log.adapter))
+}
+
+// SetLogLevel sets the level statements are logged at on this database (the default is debug).
+// Statements which fail are always logged at error level.
+func (db *DB) SetLogLevel(level slog.Level) {
+	db.log.mu.Lock()
+	db.log.level = level
+	db.log.mu.Unlock()
+}
+
+// Logger returns the logger used by this database
+func (db *DB) Logger() *slog.Logger {
+	db.log.mu.RLock()
+	defer db.log.mu.RUnlock()
+	return db.log.logger
+}
+
+// SetLogger sets the logger used by the default database
+func SetLogger(logger *slog.Logger) {
+	database.SetLogger(logger)
+}
+
+// SetLogLevel sets the level statements are logged at on the default database
+func SetLogLevel(level slog.Level) {
+	database.SetLogLevel(level)
+}
+
+// logStatement logs the statement described by e
+func (db *DB) logStatement(ctx context.Context, e *Event) {
+	db.log.mu.RLock()
+	logger, level := db.log.logger, db.log.level
+	db.log.mu.RUnlock()
+
+	msg := "query: statement"
+	if e.Err != nil {
+		msg = "query: statement failed"
+		level = slog.LevelError
+	}
+
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("sql", e.SQL),
+		slog.Any("args", e.Args),
+		slog.Duration("duration", e.Duration),
+		slog.String("adapter", db.log.adapter),
+		slog.String("table", e.Table),
+		slog.String("operation", e.Operation),
+	}
+	if e.RowsAffected >= 0 {
+		attrs = append(attrs, slog.Int64("rows", e.RowsAffected))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.Any("error", e.Err))
+	}
+
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
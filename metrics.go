@@ -0,0 +1,233 @@
+package query
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives measurements from a database, and may be implemented by an exporter.
+// ObserveStatement is called after every statement executed, and ObservePool
+// when pool stats are collected with CollectPoolStats.
+type Metrics interface {
+	ObserveStatement(operation, table string, duration time.Duration, err error)
+	ObservePool(stats sql.DBStats)
+}
+
+// metricsConfig holds the metrics for a database
+type metricsConfig struct {
+	mu      sync.RWMutex
+	metrics Metrics
+}
+
+// SetMetrics sets the metrics which statements on this database are reported to, nil disables metrics
+func (db *DB) SetMetrics(m Metrics) {
+	db.metrics.mu.Lock()
+	defer db.metrics.mu.Unlock()
+	db.metrics.metrics = m
+}
+
+// PoolStats returns the connection pool stats for this database
+func (db *DB) PoolStats() sql.DBStats {
+	sqlDB := db.adapter.SQLDB()
+	if sqlDB == nil {
+		return sql.DBStats{}
+	}
+	return sqlDB.Stats()
+}
+
+// CollectPoolStats reports the current pool stats to the metrics set on this database,
+// exporters should call this when metrics are collected.
+func (db *DB) CollectPoolStats() {
+	db.metrics.mu.RLock()
+	m := db.metrics.metrics
+	db.metrics.mu.RUnlock()
+	if m != nil {
+		m.ObservePool(db.PoolStats())
+	}
+}
+
+// observeStatement reports the statement described by e to the metrics, if set
+func (db *DB) observeStatement(e *Event) {
+	db.metrics.mu.RLock()
+	m := db.metrics.metrics
+	db.metrics.mu.RUnlock()
+	if m != nil {
+		m.ObserveStatement(e.Operation, e.Table, e.Duration, e.Err)
+	}
+}
+
+// SetMetrics sets the metrics for the default database
+func SetMetrics(m Metrics) {
+	database.SetMetrics(m)
+}
+
+// PoolStats returns the connection pool stats for the default database
+func PoolStats() sql.DBStats {
+	return database.PoolStats()
+}
+
+// DefaultBuckets are the upper bounds in seconds of the histogram buckets used by MetricsRegistry
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsRegistry is a simple implementation of Metrics, which keeps statement
+// counters and duration histograms by operation and table, and the latest pool stats.
+// It writes them in the prometheus plain text exposition format, for services
+// which do not bring their own exporter.
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	buckets    []float64
+	statements map[statementKey]*statementMetrics
+	pool       sql.DBStats
+}
+
+// statementKey labels statement metrics
+type statementKey struct {
+	operation string
+	table     string
+}
+
+// statementMetrics holds the counters and histogram for one operation and table
+type statementMetrics struct {
+	count   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+// NewMetricsRegistry returns a registry using buckets for duration histograms (in seconds),
+// or DefaultBuckets if none are given
+func NewMetricsRegistry(buckets ...float64) *MetricsRegistry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &MetricsRegistry{
+		buckets:    buckets,
+		statements: make(map[statementKey]*statementMetrics),
+	}
+}
+
+// ObserveStatement counts a statement and adds its duration to the histogram
+func (r *MetricsRegistry) ObserveStatement(operation, table string, duration time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := statementKey{operation: operation, table: table}
+	m := r.statements[k]
+	if m == nil {
+		m = &statementMetrics{buckets: make([]uint64, len(r.buckets))}
+		r.statements[k] = m
+	}
+
+	m.count++
+	if err != nil {
+		m.errors++
+	}
+	seconds := duration.Seconds()
+	m.sum += seconds
+	for i, le := range r.buckets {
+		if seconds <= le {
+			m.buckets[i]++
+		}
+	}
+}
+
+// ObservePool records the latest pool stats
+func (r *MetricsRegistry) ObservePool(stats sql.DBStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pool = stats
+}
+
+// WriteText writes the metrics in the prometheus plain text exposition format
+func (r *MetricsRegistry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+
+	keys := make([]statementKey, 0, len(r.statements))
+	for k := range r.statements {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].operation == keys[j].operation {
+			return keys[i].table < keys[j].table
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	b.WriteString("# HELP query_statements_total Statements executed.\n")
+	b.WriteString("# TYPE query_statements_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "query_statements_total{%s} %d\n", k.labels(), r.statements[k].count)
+	}
+
+	b.WriteString("# HELP query_statement_errors_total Statements which returned an error.\n")
+	b.WriteString("# TYPE query_statement_errors_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "query_statement_errors_total{%s} %d\n", k.labels(), r.statements[k].errors)
+	}
+
+	b.WriteString("# HELP query_statement_duration_seconds Statement execution time.\n")
+	b.WriteString("# TYPE query_statement_duration_seconds histogram\n")
+	for _, k := range keys {
+		m := r.statements[k]
+		for i, le := range r.buckets {
+			fmt.Fprintf(&b, "query_statement_duration_seconds_bucket{%s,le=\"%g\"} %d\n", k.labels(), le, m.buckets[i])
+		}
+		fmt.Fprintf(&b, "query_statement_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", k.labels(), m.count)
+		fmt.Fprintf(&b, "query_statement_duration_seconds_sum{%s} %g\n", k.labels(), m.sum)
+		fmt.Fprintf(&b, "query_statement_duration_seconds_count{%s} %d\n", k.labels(), m.count)
+	}
+
+	gauges := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"query_pool_max_open_connections", "gauge", "Maximum open connections.", float64(r.pool.MaxOpenConnections)},
+		{"query_pool_open_connections", "gauge", "Open connections.", float64(r.pool.OpenConnections)},
+		{"query_pool_in_use_connections", "gauge", "Connections in use.", float64(r.pool.InUse)},
+		{"query_pool_idle_connections", "gauge", "Idle connections.", float64(r.pool.Idle)},
+		{"query_pool_wait_count_total", "counter", "Connections waited for.", float64(r.pool.WaitCount)},
+		{"query_pool_wait_duration_seconds_total", "counter", "Time spent waiting for connections.", r.pool.WaitDuration.Seconds()},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", g.name, g.help, g.name, g.kind, g.name, g.value)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Handler returns a handler which collects pool stats from db (if not nil)
+// and writes the metrics in the plain text exposition format
+func (r *MetricsRegistry) Handler(db *DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if db != nil {
+			r.ObservePool(db.PoolStats())
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := r.WriteText(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// labels returns the labels for this key in exposition format
+func (k statementKey) labels() string {
+	return fmt.Sprintf("operation=\"%s\",table=\"%s\"", escapeLabel(k.operation), escapeLabel(k.table))
+}
+
+// escapeLabel escapes a label value for the exposition format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
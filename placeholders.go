@@ -0,0 +1,190 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Params holds named parameters for WhereNamed and SQLNamed
+type Params map[string]interface{}
+
+// rewritePlaceholders replaces each bare ? token in sql with placeholder(i), numbering from 1,
+// and returns the sql and the number of placeholders found.
+//
+// A ? within a quoted string or identifier, a comment or a postgres dollar quoted string
+// is left alone, as are the postgres jsonb operators ?| and ?&. Use ?? for a literal
+// question mark, for example the jsonb operator ? which would otherwise be a placeholder.
+// If backslash is true, a backslash escapes the next character in quoted strings (as in mysql).
+func rewritePlaceholders(sql string, placeholder func(int) string, backslash bool) (string, int) {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	count := 0
+	for i := 0; i < len(sql); i++ {
+		if end := skipLiteral(sql, i, backslash); end > i {
+			b.WriteString(sql[i : end+1])
+			i = end
+			continue
+		}
+
+		c := sql[i]
+		if c != '?' {
+			b.WriteByte(c)
+			continue
+		}
+
+		next := byte(0)
+		if i+1 < len(sql) {
+			next = sql[i+1]
+		}
+		switch {
+		case next == '?':
+			// Escaped literal question mark
+			b.WriteByte('?')
+			i++
+		case (next == '|' || next == '&') && (i+2 >= len(sql) || sql[i+2] != next):
+			// jsonb ?| and ?& operators (but not a placeholder followed by || or &&)
+			b.WriteByte(c)
+			b.WriteByte(next)
+			i++
+		default:
+			count++
+			b.WriteString(placeholder(count))
+		}
+	}
+
+	return b.String(), count
+}
+
+// rewriteNamed replaces each :name token in sql with a ? placeholder, returning the sql
+// and the args for each placeholder in order (a name used twice gives two args).
+// Tokens within literals and comments and postgres :: casts are left alone.
+// An error is returned if a name is not in params, or a param is not used.
+func rewriteNamed(sql string, params Params, backslash bool) (string, []interface{}, error) {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	var args []interface{}
+	var missing []string
+	used := make(map[string]bool)
+
+	for i := 0; i < len(sql); i++ {
+		if end := skipLiteral(sql, i, backslash); end > i {
+			b.WriteString(sql[i : end+1])
+			i = end
+			continue
+		}
+
+		c := sql[i]
+		switch {
+		case c == ':' && i+1 < len(sql) && sql[i+1] == ':':
+			// Postgres cast e.g. id::text
+			b.WriteString("::")
+			i++
+		case c == ':' && i+1 < len(sql) && (sql[i+1] == '_' || isLetter(sql[i+1])):
+			j := i + 1
+			for j < len(sql) && isIdentifier(sql[j]) {
+				j++
+			}
+			name := sql[i+1 : j]
+			v, ok := params[name]
+			if !ok && !used[name] {
+				missing = append(missing, name)
+			}
+			used[name] = true
+			args = append(args, v)
+			b.WriteByte('?')
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	var unused []string
+	for name := range params {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+
+	if len(missing) > 0 {
+		return "", nil, fmt.Errorf("query: missing named params %s in sql:%s", strings.Join(missing, ","), sql)
+	}
+	if len(unused) > 0 {
+		return "", nil, fmt.Errorf("query: unused named params %s in sql:%s", strings.Join(unused, ","), sql)
+	}
+
+	return b.String(), args, nil
+}
+
+// skipLiteral returns the index of the last byte of the quoted string or identifier, comment or
+// postgres dollar quoted string starting at sql[i], or i if none starts there. Doubled quotes
+// within quotes are escapes, as is a backslash within quoted strings if backslash is true,
+// and an unterminated literal runs to the end of sql.
+func skipLiteral(sql string, i int, backslash bool) int {
+	c := sql[i]
+	end := len(sql) - 1
+	switch {
+
+	case c == '\'' || c == '"' || c == '`':
+		for j := i + 1; j < len(sql); j++ {
+			if backslash && c != '`' && sql[j] == '\\' {
+				j++
+				continue
+			}
+			if sql[j] == c {
+				if j+1 < len(sql) && sql[j+1] == c {
+					j++
+					continue
+				}
+				return j
+			}
+		}
+
+	case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+		if j := strings.IndexByte(sql[i:], '\n'); j >= 0 {
+			return i + j
+		}
+
+	case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+		if j := strings.Index(sql[i+2:], "*/"); j >= 0 {
+			return i + 2 + j + 1
+		}
+
+	case c == '$' && dollarTag(sql[i:]) != "":
+		tag := dollarTag(sql[i:])
+		if j := strings.Index(sql[i+len(tag):], tag); j >= 0 {
+			return i + len(tag) + j + len(tag) - 1
+		}
+
+	default:
+		return i
+	}
+	return end
+}
+
+// dollarTag returns the opening tag of a dollar quoted string at the start of s e.g. $$ or $tag$,
+// or "" if none (so that $1 is not a tag)
+func dollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		if c == '$' {
+			return s[:j+1]
+		}
+		if !(c == '_' || isLetter(c) || (j > 1 && isDigit(c))) {
+			return ""
+		}
+	}
+	return ""
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// placeholderCountError returns an error for a mismatch between placeholders and args
+func placeholderCountError(sql string, placeholders, args int) error {
+	return fmt.Errorf("query: %d placeholders for %d args in sql:%s", placeholders, args, sql)
+}
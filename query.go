@@ -1,11 +1,11 @@
 // Package query lets you build and execute SQL chainable queries against a database of your choice, and defer execution of SQL until you wish to extract a count or array of models.
 
-// NB in order to allow cross-compilation, we exlude sqlite drivers by default
-// uncomment them to allow use of sqlite
+// NB the sqlite adapter uses a pure go driver, so cross-compilation remains possible
 
 package query
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sort"
@@ -15,7 +15,8 @@ import (
 
 // FIXME - this package global should in theory be protected by a mutex, even if it is only for debugging
 
-// Debug sets whether we output debug statements for SQL
+// Debug sets whether databases opened after it is set log statements to stdout.
+// Deprecated: use DB.SetLogger with a logger at debug level instead.
 var Debug bool
 
 func init() {
@@ -31,6 +32,12 @@ type Func func(q *Query) *Query
 // Query provides all the chainable relational query builder methods
 type Query struct {
 
+	// The database handle this query executes against
+	db *DB
+
+	// The context used when executing this query, set with WithContext()
+	ctx context.Context
+
 	// Database - database name and primary key, set with New()
 	tablename  string
 	primarykey string
@@ -46,11 +53,31 @@ type Query struct {
 	offset string
 	limit  string
 
-	// Extra args to be substituted in the *where* clause
+	// Args for each clause, combined in sql order by QueryString
+	selArgs    []interface{}
+	joinArgs   []interface{}
+	whereArgs  []interface{}
+	groupArgs  []interface{}
+	havingArgs []interface{}
+	orderArgs  []interface{}
+
+	// Args for the sql, built by QueryString or set by SQLNamed
 	args []interface{}
+
+	// Error building the query, returned on execution
+	err error
+
+	// An IN list too long for one statement, split into chunks on execution
+	chunk *inChunk
+
+	// Whether OrWhere has joined where clauses with OR, so that IN lists cannot be split into chunks
+	orWhere bool
+
+	// Whether the sql was set with SQL or SQLNamed, so that it is kept by other setters
+	raw bool
 }
 
-// New builds a new Query, given the table and primary key
+// New builds a new Query on the default database, given the table and primary key
 func New(t string, pk string) *Query {
 
 	// If we have no db, return nil
@@ -58,31 +85,36 @@ func New(t string, pk string) *Query {
 		return nil
 	}
 
-	q := &Query{
-		tablename:  t,
-		primarykey: pk,
-	}
-
-	return q
+	return database.New(t, pk)
 }
 
-// Exec the given sql and args against the database directly
+// Exec the given sql and args against the default database directly
 // Returning sql.Result (NB not rows)
 func Exec(sql string, args ...interface{}) (sql.Result, error) {
-	results, err := database.Exec(sql, args...)
-	return results, err
+	return database.Exec(sql, args...)
 }
 
-// Rows executes the given sql and args against the database directly
+// Rows executes the given sql and args against the default database directly
 // Returning sql.Rows
 func Rows(sql string, args ...interface{}) (*sql.Rows, error) {
-	results, err := database.Query(sql, args...)
-	return results, err
+	return database.Rows(sql, args...)
+}
+
+// ExecContext executes the given sql and args against the default database using the given context
+func ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	return database.ExecContext(ctx, sql, args...)
+}
+
+// RowsContext executes the given sql and args against the default database using the given context
+func RowsContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return database.RowsContext(ctx, sql, args...)
 }
 
 // Copy returns a new copy of this query which can be mutated without affecting the original
 func (q *Query) Copy() *Query {
 	return &Query{
+		db:         q.db,
+		ctx:        q.ctx,
 		tablename:  q.tablename,
 		primarykey: q.primarykey,
 		sql:        q.sql,
@@ -94,7 +126,17 @@ func (q *Query) Copy() *Query {
 		order:      q.order,
 		offset:     q.offset,
 		limit:      q.limit,
-		args:       q.args,
+		selArgs:    copyArgs(q.selArgs),
+		joinArgs:   copyArgs(q.joinArgs),
+		whereArgs:  copyArgs(q.whereArgs),
+		groupArgs:  copyArgs(q.groupArgs),
+		havingArgs: copyArgs(q.havingArgs),
+		orderArgs:  copyArgs(q.orderArgs),
+		args:       copyArgs(q.args),
+		err:        q.err,
+		chunk:      q.chunk,
+		orWhere:    q.orWhere,
+		raw:        q.raw,
 	}
 }
 
@@ -129,11 +171,7 @@ func (q *Query) InsertJoins(a []int64, b []int64) error {
 
 	sql := fmt.Sprintf("INSERT into %s VALUES %s;", q.table(), values)
 
-	if Debug {
-		fmt.Printf("JOINS SQL:%s\n", sql)
-	}
-
-	_, err := database.Exec(sql)
+	_, err := q.db.exec(q.context(), "InsertJoins", q.tablename, sql, nil)
 	if err != nil {
 		return fmt.Errorf("query: insert joins:%s", err)
 	}
@@ -143,9 +181,7 @@ func (q *Query) InsertJoins(a []int64, b []int64) error {
 // UpdateJoins updates the given joins, using the given id to clear joins first
 func (q *Query) UpdateJoins(id int64, a []int64, b []int64) error {
 
-	if Debug {
-		fmt.Printf("SetJoins %s %s=%d: %v %v \n", q.table(), q.pk(), id, a, b)
-	}
+	q.db.Logger().Debug("query: update joins", "table", q.tablename, q.pk(), id, "a", a, "b", b)
 
 	// First delete any existing joins
 	err := q.Where(fmt.Sprintf("%s=?", q.pk()), id).Delete()
@@ -173,11 +209,7 @@ func (q *Query) Insert(params map[string]string) (int64, error) {
 	// Insert and retrieve ID in one step from db
 	sql := q.insertSQL(params)
 
-	if Debug {
-		fmt.Printf("INSERT SQL:%s %v\n", sql, valuesFromParams(params))
-	}
-
-	id, err := database.Insert(sql, valuesFromParams(params)...)
+	id, err := q.db.insert(q.context(), "Insert", q.tablename, sql, valuesFromParams(params))
 	if err != nil {
 		return 0, err
 	}
@@ -191,10 +223,10 @@ func (q *Query) insertSQL(params map[string]string) string {
 	var cols, vals []string
 
 	for i, k := range sortedParamKeys(params) {
-		cols = append(cols, database.QuoteField(k))
-		vals = append(vals, database.Placeholder(i+1))
+		cols = append(cols, q.db.adapter.QuoteField(k))
+		vals = append(vals, q.db.adapter.Placeholder(i+1))
 	}
-	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES(%s) %s;", q.table(), strings.Join(cols, ","), strings.Join(vals, ","), database.InsertSQL(q.pk()))
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES(%s) %s;", q.table(), strings.Join(cols, ","), strings.Join(vals, ","), q.db.adapter.InsertSQL(q.pk()))
 
 	return query
 }
@@ -214,6 +246,9 @@ func (q *Query) Delete() error {
 
 // UpdateAll updates all models specified in this relation
 func (q *Query) UpdateAll(params map[string]string) error {
+	if q.raw {
+		return fmt.Errorf("query: UpdateAll cannot be used with sql set by SQL or SQLNamed")
+	}
 
 	// Build query SQL, allowing for null fields
 	var output []string
@@ -222,70 +257,88 @@ func (q *Query) UpdateAll(params map[string]string) error {
 		// Special case the value 'null'
 		if v == "null" {
 			// Set the value to null in the db, rather than a value
-			output = append(output, fmt.Sprintf("%s=null", database.QuoteField(key)))
+			output = append(output, fmt.Sprintf("%s=null", q.db.adapter.QuoteField(key)))
 			// Remove from params as we have added to the update statement and don't require an argument
 			delete(params, key)
 		} else {
 			// Set the value using a placeholder
-			output = append(output, fmt.Sprintf("%s=?", database.QuoteField(key)))
+			output = append(output, fmt.Sprintf("%s=?", q.db.adapter.QuoteField(key)))
 		}
 	}
 	querySQL := strings.Join(output, ",")
 
 	// Create sql for update from all params except null params using placeholders for args
-	q.Select(fmt.Sprintf("UPDATE %s SET %s", q.table(), querySQL))
-
-	// Execute, after PREpending params to args
-	// In an update statement, the where comes at the end so update args come first
-	values := valuesFromParams(params)
-	q.args = append(values, q.args...)
-
-	// If debug mode, output a string representation
-	if Debug {
-		fmt.Printf("UPDATE SQL:%s\n%v\n", q.QueryString(), values)
-	}
+	// the update args come before any where args, as they are in the sql
+	q.Select(fmt.Sprintf("UPDATE %s SET %s", q.table(), querySQL), valuesFromParams(params)...)
 
 	// Return the result of execution
-	_, err := q.Result()
+	_, err := q.result("UpdateAll")
 	return err
 }
 
 // DeleteAll delets *all* models specified in this relation
 func (q *Query) DeleteAll() error {
+	if q.raw {
+		return fmt.Errorf("query: DeleteAll cannot be used with sql set by SQL or SQLNamed")
+	}
 
 	q.Select(fmt.Sprintf("DELETE FROM %s", q.table()))
 
-	if Debug {
-		fmt.Printf("DELETE SQL:%s <= %v\n", q.QueryString(), q.args)
-	}
-
 	// Execute
-	_, err := q.Result()
+	_, err := q.result("DeleteAll")
 
 	return err
 }
 
 // Count fetches a count of model objects (executes SQL).
 func (q *Query) Count() (int64, error) {
+	if q.raw {
+		return 0, fmt.Errorf("query: Count cannot be used with sql set by SQL or SQLNamed")
+	}
 
 	// In order to get consistent results, we use the same query builder
 	// but reset select to simple count select
 
 	// Store the previous select and set
-	s := q.sel
+	s, sa := q.sel, q.selArgs
 	countSelect := fmt.Sprintf("SELECT COUNT(distinct %s.%s) FROM %s", q.table(), q.pk(), q.table())
 	q.Select(countSelect)
 
-	// Store the previous order (minus order by) and set to empty
+	// Store the previous order and set to empty
 	// Order must be blank on count because of limited select
-	o := strings.Replace(q.order, "ORDER BY ", "", 1)
-	q.order = ""
+	o, oa := q.order, q.orderArgs
+	q.order, q.orderArgs = "", nil
 
 	// Fetch count from db for our sql with count select and no order set
 	var count int64
-	rows, err := q.Rows()
+	var err error
+	if q.chunk != nil {
+		// Each chunk counts in a single row, so any limit and offset are dropped
+		l, off := q.limit, q.offset
+		q.limit, q.offset = "", ""
+		count, err = q.chunkedCount()
+		q.limit, q.offset = l, off
+	} else {
+		count, err = q.count()
+	}
 	if err != nil {
-		return 0, fmt.Errorf("query: error querying database for count: %s\nQuery:%s", err, q.QueryString())
+		return 0, err
+	}
+
+	// Reset select and order after getting count query
+	q.sel, q.selArgs = s, sa
+	q.order, q.orderArgs = o, oa
+	q.reset()
+
+	return count, err
+}
+
+// count fetches the count for a query with a count select
+func (q *Query) count() (int64, error) {
+	var count int64
+	rows, err := q.rows("Count")
+	if err != nil {
+		return 0, fmt.Errorf("query: error querying database for count: %w\nQuery:%s", err, q.QueryString())
 	}
 
 	// We expect just one row, with one column (count)
@@ -296,27 +349,54 @@ func (q *Query) Count() (int64, error) {
 			return 0, err
 		}
 	}
-
-	// Reset select after getting count query
-	q.Select(s)
-	q.Order(o)
-	q.reset()
-
-	return count, err
+	return count, nil
 }
 
 // Result executes the query against the database, returning sql.Result, and error (no rows)
 // (Executes SQL)
 func (q *Query) Result() (sql.Result, error) {
-	results, err := database.Exec(q.QueryString(), q.args...)
-	return results, err
+	return q.result("Result")
 }
 
 // Rows executes the query against the database, and return the sql rows result for this query
 // (Executes SQL)
 func (q *Query) Rows() (*sql.Rows, error) {
-	results, err := database.Query(q.QueryString(), q.args...)
-	return results, err
+	return q.rows("Rows")
+}
+
+// InsertContext inserts a record in the database using the given context
+func (q *Query) InsertContext(ctx context.Context, params map[string]string) (int64, error) {
+	return q.WithContext(ctx).Insert(params)
+}
+
+// UpdateAllContext updates all models specified in this relation using the given context
+func (q *Query) UpdateAllContext(ctx context.Context, params map[string]string) error {
+	return q.WithContext(ctx).UpdateAll(params)
+}
+
+// DeleteAllContext deletes all models specified in this relation using the given context
+func (q *Query) DeleteAllContext(ctx context.Context) error {
+	return q.WithContext(ctx).DeleteAll()
+}
+
+// CountContext fetches a count of model objects using the given context (executes SQL).
+func (q *Query) CountContext(ctx context.Context) (int64, error) {
+	return q.WithContext(ctx).Count()
+}
+
+// ResultContext executes the query using the given context, returning sql.Result (no rows)
+func (q *Query) ResultContext(ctx context.Context) (sql.Result, error) {
+	return q.WithContext(ctx).Result()
+}
+
+// RowsContext executes the query using the given context, and returns the sql rows result
+func (q *Query) RowsContext(ctx context.Context) (*sql.Rows, error) {
+	return q.WithContext(ctx).Rows()
+}
+
+// ResultsContext returns an array of results, executing the query with the given context
+func (q *Query) ResultsContext(ctx context.Context) ([]Result, error) {
+	return q.WithContext(ctx).Results()
 }
 
 // FirstResult executes the SQL and returrns the first result
@@ -391,32 +471,42 @@ func (q *Query) ResultFloat64(c string) (float64, error) {
 // Results returns an array of results
 func (q *Query) Results() ([]Result, error) {
 
+	// Long IN lists are fetched in chunks
+	if q.chunk != nil && q.err == nil {
+		return q.chunkedResults()
+	}
+
 	// Make an empty result set map
 	var results []Result
 
-	// Fetch rows from db for our sql
-	rows, err := q.Rows()
+	// Fetch rows from db for our sql, reading them before hooks are called so that they know the rows read
+	var readErr error
+	err := q.readRows("Results", func(rows *sql.Rows) (int, error) {
 
-	if err != nil {
-		return results, fmt.Errorf("Error querying database for rows: %s\nQUERY:%s", err, q)
-	}
+		// Fetch the columns from the database
+		cols, err := rows.Columns()
+		if err != nil {
+			readErr = fmt.Errorf("Error fetching columns: %s\nQUERY:%s\nCOLS:%s", err, q.QueryString(), cols)
+			return 0, readErr
+		}
 
-	// Close rows before returning
-	defer rows.Close()
+		// For each row, construct an entry in results with a map of column string keys to values
+		for rows.Next() {
+			result, err := scanRow(cols, rows)
+			if err != nil {
+				readErr = fmt.Errorf("Error fetching row: %s\nQUERY:%s\nCOLS:%s", err, q.QueryString(), cols)
+				return len(results), readErr
+			}
+			results = append(results, result)
+		}
+		return len(results), nil
+	})
 
-	// Fetch the columns from the database
-	cols, err := rows.Columns()
-	if err != nil {
-		return results, fmt.Errorf("Error fetching columns: %s\nQUERY:%s\nCOLS:%s", err, q, cols)
+	if readErr != nil {
+		return results, readErr
 	}
-
-	// For each row, construct an entry in results with a map of column string keys to values
-	for rows.Next() {
-		result, err := scanRow(cols, rows)
-		if err != nil {
-			return results, fmt.Errorf("Error fetching row: %s\nQUERY:%s\nCOLS:%s", err, q, cols)
-		}
-		results = append(results, result)
+	if err != nil {
+		return results, fmt.Errorf("Error querying database for rows: %w\nQUERY:%s", err, q.QueryString())
 	}
 
 	return results, nil
@@ -426,9 +516,7 @@ func (q *Query) Results() ([]Result, error) {
 // FIXME - this should really use the query primary key, not "id" hardcoded
 func (q *Query) ResultIDs() []int64 {
 	var ids []int64
-	if Debug {
-		fmt.Printf("#info ResultIDs:%s\n", q.DebugString())
-	}
+	q.db.Logger().Debug("query: result ids", "query", q.DebugString())
 	results, err := q.Results()
 	if err != nil {
 		return ids
@@ -459,9 +547,7 @@ func (q *Query) ResultIDSets(a, b string) map[int64][]int64 {
 			idSets[av] = append(idSets[av], bv)
 		}
 	}
-	if Debug {
-		fmt.Printf("#info ResultIDSets:%s\n", q.DebugString())
-	}
+	q.db.Logger().Debug("query: result id sets", "query", q.DebugString(), "sets", len(idSets))
 	return idSets
 }
 
@@ -477,6 +563,12 @@ func (q *Query) QueryString() string {
 		}
 
 		q.sql = fmt.Sprintf("%s %s %s %s %s %s %s %s", q.sel, q.join, q.where, q.group, q.having, q.order, q.offset, q.limit)
+
+		// Combine the args for each clause in the same order
+		q.args = nil
+		for _, args := range [][]interface{}{q.selArgs, q.joinArgs, q.whereArgs, q.groupArgs, q.havingArgs, q.orderArgs} {
+			q.args = append(q.args, args...)
+		}
 		q.sql = strings.TrimRight(q.sql, " ")
 		q.sql = strings.Replace(q.sql, "  ", " ", -1)
 		q.sql = strings.Replace(q.sql, "   ", " ", -1)
@@ -507,11 +599,40 @@ func (q *Query) Conditions(funcs ...Func) *Query {
 	return q
 }
 
+// WithContext sets the context used when this query is executed,
+// so that cancellation and deadlines are passed on to the database
+func (q *Query) WithContext(ctx context.Context) *Query {
+	q.ctx = ctx
+	return q
+}
+
 // SQL defines sql manually and overrides all other setters
-// Completely replaces all stored sql
+// Completely replaces all stored sql, which later setters such as Limit do not change
 func (q *Query) SQL(sql string) *Query {
-	q.sql = sql
 	q.reset()
+	q.sql = sql
+	q.args = nil
+	q.raw = true
+	return q
+}
+
+// SQLNamed defines sql manually with :name params, replacing all stored sql and args.
+// Each :name is replaced with a placeholder for the value in params, and names may be used more than once.
+// A missing or unused name is returned as an error when the query is executed.
+func (q *Query) SQLNamed(sql string, params Params) *Query {
+	named, args, err := rewriteNamed(sql, params, q.db.adapter.BackslashEscapes())
+	if err != nil {
+		q.err = err
+		return q
+	}
+
+	query, count := rewritePlaceholders(named, q.db.adapter.Placeholder, q.db.adapter.BackslashEscapes())
+	if count != len(args) {
+		q.err = placeholderCountError(sql, count, len(args))
+	}
+
+	q.SQL(query)
+	q.args = args
 	return q
 }
 
@@ -538,67 +659,75 @@ func (q *Query) Where(sql string, args ...interface{}) *Query {
 		q.where = fmt.Sprintf("WHERE (%s)", sql)
 	}
 
-	// NB this assumes that args are only supplied for where clauses
-	// this may be an incorrect assumption!
-	if args != nil {
-		if q.args == nil {
-			q.args = args
-		} else {
-			q.args = append(q.args, args...)
-		}
-	}
+	q.whereArgs = append(q.whereArgs, args...)
 
 	q.reset()
 	return q
 }
 
+// WhereNamed defines a WHERE clause using :name params, e.g.
+// WhereNamed("status = :status AND created_at > :since", query.Params{"status": 100, "since": t})
+// Names may be used more than once, and a missing or unused name is returned as an error when the query is executed.
+func (q *Query) WhereNamed(sql string, params Params) *Query {
+	named, args, err := rewriteNamed(sql, params, q.db.adapter.BackslashEscapes())
+	if err != nil {
+		q.err = err
+		return q
+	}
+	return q.Where(named, args...)
+}
+
 // OrWhere defines a where clause on SQL - Additional calls add WHERE () OR () clauses
 func (q *Query) OrWhere(sql string, args ...interface{}) *Query {
 
 	if len(q.where) > 0 {
 		q.where = fmt.Sprintf("%s OR (%s)", q.where, sql)
+		q.orWhere = true
 	} else {
 		q.where = fmt.Sprintf("WHERE (%s)", sql)
 	}
 
-	if args != nil {
-		if q.args == nil {
-			q.args = args
-		} else {
-			q.args = append(q.args, args...)
-		}
-	}
+	q.whereArgs = append(q.whereArgs, args...)
 
 	q.reset()
 	return q
 }
 
 // WhereIn adds a Where clause which selects records IN() the given array
-// If IDs is an empty array, the query limit is set to 0
+// If IDs is an empty array, the clause is always false so no records are selected
 func (q *Query) WhereIn(col string, IDs []int64) *Query {
-	// Return no results, so that when chaining callers
-	// don't have to check for empty arrays
-	if len(IDs) == 0 {
-		q.Limit(0)
-		q.reset()
-		return q
-	}
+	return WhereIn(q, col, IDs)
+}
 
-	in := ""
-	for _, ID := range IDs {
-		in = fmt.Sprintf("%s%d,", in, ID)
-	}
-	in = strings.TrimRight(in, ",")
-	sql := fmt.Sprintf("%s IN (%s)", col, in)
+// WhereNotIn adds a Where clause which selects records NOT IN() the given array
+// If IDs is an empty array, the clause is always true
+func (q *Query) WhereNotIn(col string, IDs []int64) *Query {
+	return WhereNotIn(q, col, IDs)
+}
 
-	if len(q.where) > 0 {
-		q.where = fmt.Sprintf("%s AND (%s)", q.where, sql)
-	} else {
-		q.where = fmt.Sprintf("WHERE (%s)", sql)
-	}
+// WhereIn adds a Where clause to q which selects records with col IN() the values given,
+// which may be of any type (e.g. strings or UUIDs) and are passed as args.
+// If values is empty, the clause is always false so that every operation selects no records.
+// The col is used as given, use WhereExpr(In(col, values)) to quote it.
+//
+// Lists longer than the adapter's in_chunk_size option are bound as a single array
+// where the adapter supports it (psql), or else executed in chunks with merged results.
+// Repeated values are removed from long lists. Chunked queries may be ordered only by plain
+// columns, which are sorted again in Go once merged, and may not use offset, group, having or OrWhere.
+func WhereIn[T any](q *Query, col string, values []T) *Query {
+	return q.whereIn(col, false, values, interfaceValues(values))
+}
 
-	q.reset()
-	return q
+// WhereNotIn adds a Where clause to q which selects records with col NOT IN() the values given.
+// If values is empty, the clause is always true. Lists longer than the adapter's in_chunk_size
+// are bound as a single array where supported, or else returned as an error on execution.
+func WhereNotIn[T any](q *Query, col string, values []T) *Query {
+	return q.whereIn(col, true, values, interfaceValues(values))
+}
+
+// noQuote returns name unquoted
+func noQuote(name string) string {
+	return name
 }
 
 // Define a join clause on SQL - we create an inner join like this:
@@ -619,7 +748,7 @@ func (q *Query) Join(otherModel string) *Query {
 	sort.Strings(tables)
 	joinTable := fmt.Sprintf("%s_%s", tables[0], tables[1])
 
-	sql := fmt.Sprintf("INNER JOIN %s ON %s.id = %s.%s_id", database.QuoteField(joinTable), database.QuoteField(modelTable), database.QuoteField(joinTable), ToSingular(modelTable))
+	sql := fmt.Sprintf("INNER JOIN %s ON %s.id = %s.%s_id", q.db.adapter.QuoteField(joinTable), q.db.adapter.QuoteField(modelTable), q.db.adapter.QuoteField(joinTable), ToSingular(modelTable))
 
 	if len(q.join) > 0 {
 		q.join = fmt.Sprintf("%s %s", q.join, sql)
@@ -631,50 +760,55 @@ func (q *Query) Join(otherModel string) *Query {
 	return q
 }
 
-// AddJoinString appends a fully specified join string to the list of joins
-func (q *Query) AddJoinString(joinSQL string) *Query {
+// AddJoinString appends a fully specified join string to the list of joins, with args for any placeholders
+func (q *Query) AddJoinString(joinSQL string, args ...interface{}) *Query {
 	q.join = fmt.Sprintf("%s %s", q.join, joinSQL)
+	q.joinArgs = append(q.joinArgs, args...)
 	q.reset()
 	return q
 }
 
-// Order defines ORDER BY sql
-func (q *Query) Order(sql string) *Query {
+// Order defines ORDER BY sql, with args for any placeholders
+func (q *Query) Order(sql string, args ...interface{}) *Query {
 	if sql == "" {
 		q.order = ""
 	} else {
 		q.order = fmt.Sprintf("ORDER BY %s", sql)
 	}
+	q.orderArgs = args
 	q.reset()
 
 	return q
 }
 
-// Group defines GROUP BY sql
-func (q *Query) Group(sql string) *Query {
+// Group defines GROUP BY sql, with args for any placeholders
+func (q *Query) Group(sql string, args ...interface{}) *Query {
 	if sql == "" {
 		q.group = ""
 	} else {
 		q.group = fmt.Sprintf("GROUP BY %s", sql)
 	}
+	q.groupArgs = args
 	q.reset()
 	return q
 }
 
-// Having defines HAVING sql
-func (q *Query) Having(sql string) *Query {
+// Having defines HAVING sql, with args for any placeholders
+func (q *Query) Having(sql string, args ...interface{}) *Query {
 	if sql == "" {
 		q.having = ""
 	} else {
 		q.having = fmt.Sprintf("HAVING %s", sql)
 	}
+	q.havingArgs = args
 	q.reset()
 	return q
 }
 
-// Select defines SELECT  sql
-func (q *Query) Select(sql string) *Query {
+// Select defines SELECT  sql, with args for any placeholders
+func (q *Query) Select(sql string, args ...interface{}) *Query {
 	q.sel = sql
+	q.selArgs = args
 	q.reset()
 	return q
 }
@@ -688,6 +822,11 @@ func (q *Query) DebugString() string {
 func (q *Query) reset() {
 	// Perhaps later clear cached compiled representation of query too
 
+	// Keep sql set manually, which overrides all other setters
+	if q.raw {
+		return
+	}
+
 	// clear stored sql
 	q.sql = ""
 }
@@ -728,22 +867,76 @@ func (q *Query) argToString(arg interface{}) string {
 
 }
 
+// Return the context for executing this query, or a background context if none set
+func (q *Query) context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
+}
+
+// Execute the query for the named operation, returning sql.Result
+func (q *Query) result(op string) (sql.Result, error) {
+	query := q.QueryString()
+	if q.err != nil {
+		return nil, q.err
+	}
+	if q.chunk != nil {
+		return q.chunkedResult(op)
+	}
+	return q.db.exec(q.context(), op, q.tablename, query, q.args)
+}
+
+// Execute the query for the named operation, returning sql.Rows
+func (q *Query) rows(op string) (*sql.Rows, error) {
+	query := q.QueryString()
+	if q.err != nil {
+		return nil, q.err
+	}
+	if q.chunk != nil {
+		return nil, fmt.Errorf("query: IN list of %d values for %s exceeds the chunk size %d, and cannot be split for %s", len(q.chunk.values), q.chunk.col, q.chunk.size, op)
+	}
+	return q.db.query(q.context(), op, q.tablename, query, q.args)
+}
+
+// Execute the query for the named operation, reading the rows returned with read
+func (q *Query) readRows(op string, read func(rows *sql.Rows) (int, error)) error {
+	query := q.QueryString()
+	if q.err != nil {
+		return q.err
+	}
+	if q.chunk != nil {
+		return fmt.Errorf("query: IN list of %d values for %s exceeds the chunk size %d, and cannot be split for %s", len(q.chunk.values), q.chunk.col, q.chunk.size, op)
+	}
+	return q.db.queryRows(q.context(), op, q.tablename, query, q.args, read)
+}
+
 // Ask model for primary key name to use
 func (q *Query) pk() string {
-	return database.QuoteField(q.primarykey)
+	return q.db.adapter.QuoteField(q.primarykey)
 }
 
 // Ask model for table name to use
 func (q *Query) table() string {
-	return database.QuoteField(q.tablename)
+	return q.db.adapter.QuoteField(q.tablename)
 }
 
 // Replace ? with whatever database prefers (psql uses numbered args)
+// placeholders in literals and comments are ignored, and ?? is a literal ?
 func (q *Query) replaceArgPlaceholders() {
-	// Match ? and replace with argument placeholder from database
-	for i := range q.args {
-		q.sql = strings.Replace(q.sql, "?", database.Placeholder(i+1), 1)
+	sql, count := rewritePlaceholders(q.sql, q.db.adapter.Placeholder, q.db.adapter.BackslashEscapes())
+	if count != len(q.args) {
+		q.err = placeholderCountError(q.sql, count, len(q.args))
+	}
+	q.sql = sql
+}
+
+// copyArgs returns a copy of args, so that copies of a query do not share them
+func copyArgs(args []interface{}) []interface{} {
+	if args == nil {
+		return nil
 	}
+	return append([]interface{}(nil), args...)
 }
 
 // Sorts the param names given - map iteration order is explicitly random in Go
@@ -1,17 +1,31 @@
 package query
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"github.com/fragmenta/query/adapters"
 )
 
-// At present psql and mysql are tested, sqlite is disabled due to cross-compilation requirements
+// psql and mysql tests require a server with a query_test database, sqlite tests use an in memory database
 
 // Pages is a simple example model for testing the query package which stores some fields in the db.
 // All functions prefixed with Pages here - normally the model would be in a separate function
@@ -31,94 +45,1478 @@ type Page struct {
 	UnusedField int8
 }
 
-// Create a model object, called from actions.
-func (p *Page) Create(params map[string]string) (int64, error) {
-	params["created_at"] = TimeString(time.Now().UTC())
-	params["updated_at"] = TimeString(time.Now().UTC())
-	return PagesQuery().Insert(params)
-}
+// Create a model object, called from actions.
+func (p *Page) Create(params map[string]string) (int64, error) {
+	params["created_at"] = TimeString(time.Now().UTC())
+	params["updated_at"] = TimeString(time.Now().UTC())
+	return PagesQuery().Insert(params)
+}
+
+// Update this model object, called from actions.
+func (p *Page) Update(params map[string]string) error {
+	params["updated_at"] = TimeString(time.Now().UTC())
+	return PagesQuery().Where("id=?", p.ID).Update(params)
+}
+
+// Delete this page
+func (p *Page) Delete() error {
+	return PagesQuery().Where("id=?", p.ID).Delete()
+}
+
+// NewWithColumns creates a new page instance and fills it with data from the database cols provided
+func PagesNewWithColumns(cols map[string]interface{}) *Page {
+
+	page := PagesNew()
+
+	// Normally you'd validate col values with something like the model/validate pkg
+	// we'll use a simple dummy function instead
+	page.ID = cols["id"].(int64)
+	if cols["created_at"] != nil {
+		page.CreatedAt = cols["created_at"].(time.Time)
+	}
+	if cols["updated_at"] != nil {
+		page.UpdatedAt = cols["updated_at"].(time.Time)
+	}
+
+	if cols["title"] != nil {
+		page.Title = cols["title"].(string)
+	}
+	if cols["summary"] != nil {
+		page.Summary = cols["summary"].(string)
+	}
+	if cols["text"] != nil {
+		page.Text = cols["text"].(string)
+	}
+
+	return page
+}
+
+// New initialises and returns a new Page
+func PagesNew() *Page {
+	page := &Page{}
+	return page
+}
+
+// Query returns a new query for pages
+func PagesQuery() *Query {
+	return New("pages", "id")
+}
+
+func PagesFind(ID int64) (*Page, error) {
+	result, err := PagesQuery().Where("id=?", ID).FirstResult()
+	if err != nil {
+		return nil, err
+	}
+	return PagesNewWithColumns(result), nil
+}
+
+func PagesFindAll(q *Query) ([]*Page, error) {
+	results, err := q.Results()
+	if err != nil {
+		return nil, err
+	}
+
+	var models []*Page
+	for _, r := range results {
+		m := PagesNewWithColumns(r)
+		models = append(models, m)
+	}
+
+	return models, nil
+}
+
+// ----------------------------------
+// Test Helpers
+// ----------------------------------
+
+var User = os.ExpandEnv("$USER")
+var Password = os.ExpandEnv("$QUERY_TEST_PASS") // may be blank
+
+var Format = "\n---\nFAILURE\n---\ninput:    %q\nexpected: %q\noutput:   %q"
+
+// ----------------------------------
+// HANDLE TESTS
+// ----------------------------------
+
+func TestOpenUnknownAdapter(t *testing.T) {
+
+	db, err := Open(map[string]string{"adapter": "nosuchdb"})
+	if err == nil || db != nil {
+		t.Fatalf(Format, "Open nosuchdb", "error", db)
+	}
+
+	// The default database should be untouched by a failed open
+	err = OpenDatabase(map[string]string{"adapter": "nosuchdb"})
+	if err == nil || database != nil {
+		t.Fatalf(Format, "OpenDatabase nosuchdb", "error", err)
+	}
+
+}
+
+func TestRegisterAdapter(t *testing.T) {
+
+	RegisterAdapter("test_fake", func() adapters.Database { return &adapters.FakeAdapter{} })
+	t.Cleanup(func() { unregisterAdapter("test_fake") })
+
+	names := "," + strings.Join(Adapters(), ",") + ","
+	if !strings.Contains(names, ",test_fake,") || !strings.Contains(names, ",postgres,") {
+		t.Fatalf(Format, "Adapters", "test_fake and postgres", names)
+	}
+
+	db, err := Open(map[string]string{"adapter": "test_fake"})
+	if err != nil {
+		t.Fatalf(Format, "Open registered adapter", "nil", err)
+	}
+	db.Close()
+
+	// Registering the same name twice should panic
+	defer func() {
+		if recover() == nil {
+			t.Fatalf(Format, "RegisterAdapter duplicate", "panic", nil)
+		}
+	}()
+	RegisterAdapter("postgres", func() adapters.Database { return &adapters.PostgresqlAdapter{} })
+
+}
+
+// unregisterAdapter removes an adapter registered by a test, so that tests may be run again
+func unregisterAdapter(name string) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	delete(adapterFactories, name)
+}
+
+func TestOpenWithSQLDB(t *testing.T) {
+
+	sqlDB, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf(Format, "sql.Open", "nil", err)
+	}
+	defer sqlDB.Close()
+	sqlDB.SetMaxOpenConns(1)
+
+	db, err := OpenWithSQLDB("sqlite3", sqlDB)
+	if err != nil {
+		t.Fatalf(Format, "OpenWithSQLDB", "nil", err)
+	}
+
+	_, err = db.Exec("CREATE TABLE tags (id integer NOT NULL PRIMARY KEY, name text);")
+	if err != nil {
+		t.Fatalf(Format, "Create table", "nil", err)
+	}
+
+	id, err := db.New("tags", "id").Insert(map[string]string{"name": "tag"})
+	if err != nil || id != 1 {
+		t.Fatalf(Format, "Insert on existing sql.DB", "1", err)
+	}
+
+	count, err := db.New("tags", "id").Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count on existing sql.DB", "1", fmt.Sprintf("%d", count))
+	}
+
+	_, err = OpenWithSQLDB("nosuchdb", sqlDB)
+	if err == nil {
+		t.Fatalf(Format, "OpenWithSQLDB nosuchdb", "error", err)
+	}
+
+	// The pool is owned by the caller, and remains open after Close
+	db.Close()
+	err = sqlDB.Ping()
+	if err != nil {
+		t.Fatalf(Format, "Ping after Close", "nil", err)
+	}
+
+}
+
+// ----------------------------------
+// STATEMENT CACHE TESTS
+// ----------------------------------
+
+func TestStmtCache(t *testing.T) {
+
+	sqlDB, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf(Format, "sql.Open", "nil", err)
+	}
+	defer sqlDB.Close()
+
+	// The least recently used statement is evicted first
+	ctx := context.Background()
+	cache := adapters.NewStmtCache(sqlDB, 2)
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 1", "SELECT 3"} {
+		_, release, err := cache.Prepare(ctx, query)
+		if err != nil {
+			t.Fatalf(Format, "Prepare", "nil", err)
+		}
+		release()
+	}
+	if stmt, _ := cache.Get("SELECT 2"); stmt != nil {
+		t.Fatalf(Format, "LRU evicted", "SELECT 2", "cached")
+	}
+	stmt, release := cache.Get("SELECT 1")
+	if stmt == nil {
+		t.Fatalf(Format, "LRU kept", "SELECT 1", "evicted")
+	}
+	release()
+
+	stats := cache.Stats()
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Evictions != 1 || stats.Hits != 2 || stats.Misses != 4 {
+		t.Fatalf(Format, "Cache stats", "size 2, 1 eviction, 2 hits, 4 misses", stats)
+	}
+
+	// Clear closes every statement
+	cache.Clear()
+	if cache.Stats().Size != 0 || stmt.QueryRow().Scan(new(int)) == nil {
+		t.Fatalf(Format, "Clear", "closed", cache.Stats())
+	}
+
+	// A size of 0 disables the cache
+	if adapters.NewStmtCache(sqlDB, 0).Enabled() {
+		t.Fatalf(Format, "Cache size 0", "disabled", "enabled")
+	}
+	db, err := Open(map[string]string{"adapter": "sqlite3", "db": ":memory:", "stmt_cache_size": "0"})
+	if err != nil {
+		t.Fatalf(Format, "Open sqlite", "nil", err)
+	}
+	_, err = db.Exec("SELECT 1")
+	if err != nil || db.StmtCacheStats().Size != 0 || db.StmtCacheStats().Misses != 0 {
+		t.Fatalf(Format, "Cache size 0 stats", "empty", db.StmtCacheStats())
+	}
+	db.Close()
+
+	// Transactions use statements already cached, without preparing new ones on the pool
+	db, err = Open(map[string]string{"adapter": "sqlite3", "db": ":memory:"})
+	if err != nil {
+		t.Fatalf(Format, "Open sqlite", "nil", err)
+	}
+	_, err = db.Exec("SELECT 1")
+	if err != nil {
+		t.Fatalf(Format, "Exec", "nil", err)
+	}
+	err = db.Transaction(func(tx *Tx) error {
+		if _, err := tx.Exec("SELECT 1"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("SELECT 2")
+		return err
+	})
+	stats = db.StmtCacheStats()
+	if err != nil || stats.Size != 1 || stats.Hits != 1 {
+		t.Fatalf(Format, "Cache in transaction", "size 1, 1 hit", stats)
+	}
+
+	// Close clears the cache
+	db.Close()
+	if db.StmtCacheStats().Size != 0 {
+		t.Fatalf(Format, "Cache after Close", "empty", db.StmtCacheStats())
+	}
+
+}
+
+func TestStmtCacheEvictInUse(t *testing.T) {
+
+	sqlDB, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf(Format, "sql.Open", "nil", err)
+	}
+	defer sqlDB.Close()
+
+	// A statement evicted while checked out stays open until it is released
+	cache := adapters.NewStmtCache(sqlDB, 1)
+	stmt, release, err := cache.Prepare(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatalf(Format, "Prepare", "nil", err)
+	}
+	_, release2, err := cache.Prepare(context.Background(), "SELECT 2")
+	if err != nil || cache.Stats().Evictions != 1 {
+		t.Fatalf(Format, "Prepare evicting", "1 eviction", cache.Stats())
+	}
+	release2()
+
+	var n int
+	err = stmt.QueryRow().Scan(&n)
+	if err != nil || n != 1 {
+		t.Fatalf(Format, "Evicted statement in use", "1", err)
+	}
+
+	release()
+	err = stmt.QueryRow().Scan(&n)
+	if err == nil {
+		t.Fatalf(Format, "Evicted statement released", "closed", err)
+	}
+
+}
+
+func TestStmtCacheConcurrent(t *testing.T) {
+
+	// A small cache evicts statements constantly, which must not close them under other callers
+	db, err := Open(map[string]string{"adapter": "sqlite3", "db": filepath.Join(t.TempDir(), "cache.sqlite"), "stmt_cache_size": "2"})
+	if err != nil {
+		t.Fatalf(Format, "Open sqlite", "nil", err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				n := (g + i) % 50
+				rows, err := db.Rows(fmt.Sprintf("SELECT %d + ?", n), 1)
+				if err != nil {
+					errs <- err
+					return
+				}
+				var sum int
+				for rows.Next() {
+					err = rows.Scan(&sum)
+				}
+				rows.Close()
+				if err != nil || sum != n+1 {
+					errs <- fmt.Errorf("scan %d: %v", sum, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf(Format, "Concurrent cached statements", "nil", err)
+	}
+
+	stats := db.StmtCacheStats()
+	if stats.Size != 2 || stats.Evictions == 0 {
+		t.Fatalf(Format, "Concurrent cache stats", "size 2 with evictions", stats)
+	}
+
+}
+
+// ----------------------------------
+// FAKE ADAPTER TESTS
+// ----------------------------------
+
+// openFake opens a database handle on a fake adapter with the options given, closed when the test ends
+func openFake(t *testing.T, opts map[string]string) (*DB, *adapters.FakeAdapter) {
+	t.Helper()
+	fake := &adapters.FakeAdapter{}
+	db, err := OpenAdapter(fake, opts)
+	if err != nil {
+		t.Fatalf(Format, "Open fake", "nil", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+func TestFakeAdapter(t *testing.T) {
+
+	db, fake := openFake(t, nil)
+
+	fake.ExpectQuery(`SELECT "pages"\.\* FROM "pages" WHERE \(id=\?\)`).WillReturnRows([]string{"id", "title"}, []interface{}{1, "Title 1."})
+	fake.ExpectInsert(`INSERT INTO "pages"`).WillReturnResult(9, 1)
+	fake.ExpectExec(`DELETE FROM "pages"`).WillReturnError(fmt.Errorf("delete failed"))
+
+	result, err := db.New("pages", "id").Where("id=?", 1).FirstResult()
+	if err != nil || result["id"] != int64(1) || result["title"] != "Title 1." {
+		t.Fatalf(Format, "Fake query", "Title 1.", result)
+	}
+
+	id, err := db.New("pages", "id").Insert(map[string]string{"title": "Title 9"})
+	if err != nil || id != 9 {
+		t.Fatalf(Format, "Fake insert", "9", id)
+	}
+
+	err = db.New("pages", "id").Where("id=?", 9).DeleteAll()
+	if err == nil || err.Error() != "delete failed" {
+		t.Fatalf(Format, "Fake delete", "delete failed", err)
+	}
+
+	// Check calls were recorded with their args
+	calls := fake.Calls()
+	if len(calls) != 3 || calls[1].Method != "Insert" || calls[1].Args[0] != "Title 9" || calls[2].Args[0] != int64(9) {
+		t.Fatalf(Format, "Fake calls", "3 calls", calls)
+	}
+
+	err = fake.ExpectationsMet()
+	if err != nil {
+		t.Fatalf(Format, "Fake expectations", "nil", err)
+	}
+
+	// Unmet expectations should be reported
+	fake.ExpectQuery(`SELECT COUNT`)
+	if fake.ExpectationsMet() == nil {
+		t.Fatalf(Format, "Fake expectations unmet", "error", nil)
+	}
+
+}
+
+func TestFakeNestedTransaction(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	// The inner transaction is rolled back to its savepoint, executed without preparing it
+	err := db.Transaction(func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE pages SET status=1")
+		if err != nil {
+			return err
+		}
+		err = tx.Transaction(func(tx *Tx) error {
+			_, err := tx.Exec("UPDATE pages SET status=2")
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("rollback inner")
+		})
+		if err == nil || err.Error() != "rollback inner" {
+			return fmt.Errorf("unexpected inner error:%v", err)
+		}
+		return tx.Transaction(func(tx *Tx) error { return nil })
+	})
+	if err != nil {
+		t.Fatalf(Format, "Nested transaction", "nil", err)
+	}
+
+	var sqls []string
+	for _, call := range fake.Calls() {
+		sqls = append(sqls, strings.TrimSpace(call.Method+" "+call.SQL))
+	}
+	expected := "Begin,Exec UPDATE pages SET status=1,Exec SAVEPOINT query_savepoint_1,Exec UPDATE pages SET status=2," +
+		"Exec ROLLBACK TO SAVEPOINT query_savepoint_1,Exec SAVEPOINT query_savepoint_2,Exec RELEASE SAVEPOINT query_savepoint_2,Commit"
+	if strings.Join(sqls, ",") != expected {
+		t.Fatalf(Format, "Nested transaction calls", expected, strings.Join(sqls, ","))
+	}
+
+}
+
+func TestRetryTransaction(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	fake.ExpectExec(`attempt=1`).WillReturnError(&pq.Error{Code: "40001"})
+	fake.ExpectExec(`attempt=2`).WillReturnError(&mysql.MySQLError{Number: 1213})
+	fake.ExpectExec(`locked`).WillReturnError(errors.New("locked"))
+
+	// Serialization failures and deadlocks are retried until the transaction succeeds
+	opts := &RetryOptions{Backoff: time.Millisecond}
+	calls := 0
+	attempts, err := db.TransactionWithRetry(opts, func(tx *Tx) error {
+		calls++
+		_, err := tx.Exec(fmt.Sprintf("UPDATE pages SET attempt=%d", calls))
+		return err
+	})
+	if err != nil || attempts != 3 || calls != 3 {
+		t.Fatalf(Format, "Retry transaction", "3 attempts", fmt.Sprintf("%d %v", attempts, err))
+	}
+	var methods []string
+	for _, call := range fake.Calls() {
+		if call.Method != "Exec" {
+			methods = append(methods, call.Method)
+		}
+	}
+	if strings.Join(methods, ",") != "Begin,Rollback,Begin,Rollback,Begin,Commit" {
+		t.Fatalf(Format, "Retry transaction calls", "2 rollbacks then commit", methods)
+	}
+
+	// Other errors are not retried
+	attempts, err = db.TransactionWithRetry(opts, func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE pages SET locked=1")
+		return err
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf(Format, "Retry non-retryable", "1 attempt", attempts)
+	}
+
+	// Attempts stop at MaxAttempts
+	attempts, err = db.TransactionWithRetry(&RetryOptions{MaxAttempts: 2, Backoff: time.Millisecond}, func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE pages SET attempt=1")
+		return err
+	})
+	if !db.adapter.IsRetryable(err) || attempts != 2 {
+		t.Fatalf(Format, "Retry max attempts", "2 attempts", attempts)
+	}
+
+	// Cancelling the context stops the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	attempts, err = db.TransactionWithRetryContext(ctx, &RetryOptions{Backoff: time.Hour, MaxBackoff: time.Hour}, func(tx *Tx) error {
+		_, err := tx.Exec("UPDATE pages SET attempt=1")
+		return err
+	})
+	if !errors.Is(err, context.Canceled) || attempts != 1 || time.Since(start) > 5*time.Second {
+		t.Fatalf(Format, "Retry cancelled", "context canceled", fmt.Sprintf("%d %v", attempts, err))
+	}
+
+}
+
+func TestHooks(t *testing.T) {
+
+	db, fake := openFake(t, nil)
+
+	fake.ExpectQuery(`SELECT COUNT`).WillReturnRows([]string{"count"}, []interface{}{3})
+	fake.ExpectExec(`UPDATE`).WillReturnResult(0, 3)
+
+	// Record the order hooks are called in, and the events seen
+	var order []string
+	var events []*Event
+	for _, name := range []string{"a", "b"} {
+		name := name
+		db.AddHook(HookFuncs{
+			BeforeFunc: func(ctx context.Context, e *Event) context.Context {
+				order = append(order, "before "+name)
+				return ctx
+			},
+			AfterFunc: func(ctx context.Context, e *Event) {
+				order = append(order, "after "+name)
+				if name == "a" {
+					events = append(events, e)
+				}
+			},
+		})
+	}
+
+	count, err := db.New("pages", "id").Where("id > ?", 0).Count()
+	if err != nil || count != 3 {
+		t.Fatalf(Format, "Count with hooks", "3", err)
+	}
+
+	err = db.New("pages", "id").UpdateAll(map[string]string{"title": "hooked"})
+	if err != nil {
+		t.Fatalf(Format, "UpdateAll with hooks", "nil", err)
+	}
+
+	if strings.Join(order[:4], ",") != "before a,before b,after b,after a" {
+		t.Fatalf(Format, "Hook order", "before a,before b,after b,after a", order)
+	}
+
+	if len(events) != 2 || events[0].Operation != "Count" || events[0].Table != "pages" || events[0].Args[0] != 0 || events[0].Start.IsZero() {
+		t.Fatalf(Format, "Count event", "Count", events)
+	}
+
+	if events[1].Operation != "UpdateAll" || events[1].RowsAffected != 3 || events[1].Err != nil {
+		t.Fatalf(Format, "UpdateAll event", "UpdateAll", events[1])
+	}
+
+}
+
+func TestLogger(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	var buf bytes.Buffer
+	db.SetLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	fake.ExpectExec(`DELETE`).WillReturnError(errors.New("locked"))
+
+	_, err := db.New("pages", "id").Where("id=?", 5).Results()
+	if err != nil {
+		t.Fatalf(Format, "Results with logger", "nil", err)
+	}
+
+	err = db.New("pages", "id").Where("id=?", 5).DeleteAll()
+	if err == nil {
+		t.Fatalf(Format, "DeleteAll with logger", "error", err)
+	}
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf(Format, "Log entry", "json", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf(Format, "Log entries", "2", len(entries))
+	}
+
+	e := entries[0]
+	if e["level"] != "DEBUG" || e["operation"] != "Results" || e["table"] != "pages" || e["adapter"] != "fake" || !strings.Contains(e["sql"].(string), "id=?") {
+		t.Fatalf(Format, "Results log entry", "DEBUG Results", e)
+	}
+
+	e = entries[1]
+	if e["level"] != "ERROR" || e["operation"] != "DeleteAll" || e["error"] != "locked" {
+		t.Fatalf(Format, "DeleteAll log entry", "ERROR DeleteAll", e)
+	}
+
+	// Statements are not logged by an info handler unless the level is raised
+	buf.Reset()
+	db.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	_, err = db.New("pages", "id").Results()
+	if err != nil || buf.Len() != 0 {
+		t.Fatalf(Format, "Log level", "no output", buf.String())
+	}
+
+	db.SetLogLevel(slog.LevelInfo)
+	_, err = db.New("pages", "id").Results()
+	if err != nil || !strings.Contains(buf.String(), `"level":"INFO"`) {
+		t.Fatalf(Format, "Log level", "INFO", buf.String())
+	}
+
+}
+
+func TestSlowQueryLog(t *testing.T) {
+
+	db, _ := openFake(t, map[string]string{"adapter": "fake"})
+
+	// A threshold of zero records every statement, in a ring of two
+	slow := NewSlowQueryLog(0, 2)
+	var buf bytes.Buffer
+	slow.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	db.AddHook(slow)
+
+	for i := 1; i <= 3; i++ {
+		_, err := db.New("pages", "id").Where("id=?", i).Results()
+		if err != nil {
+			t.Fatalf(Format, "Results with slow log", "nil", err)
+		}
+	}
+
+	queries := slow.Queries()
+	if len(queries) != 2 || queries[0].Args[0] != 2 || queries[1].Args[0] != 3 {
+		t.Fatalf(Format, "Slow queries", "2,3", queries)
+	}
+
+	if !strings.Contains(queries[0].SQL, "id=?") || queries[0].Operation != "Results" || queries[0].Table != "pages" {
+		t.Fatalf(Format, "Slow query", "Results", queries[0])
+	}
+
+	if !strings.Contains(queries[0].Caller, "query_test.go:") {
+		t.Fatalf(Format, "Slow query caller", "query_test.go", queries[0].Caller)
+	}
+
+	if strings.Count(buf.String(), "query: slow query") != 3 {
+		t.Fatalf(Format, "Slow query log", "3 entries", buf.String())
+	}
+
+	// The log may be served as json
+	w := httptest.NewRecorder()
+	slow.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	var served []SlowQuery
+	err := json.Unmarshal(w.Body.Bytes(), &served)
+	if err != nil || len(served) != 2 {
+		t.Fatalf(Format, "Slow query json", "2", w.Body.String())
+	}
+
+	// Statements under the threshold are not recorded
+	slow.Reset()
+	slow.SetThreshold(time.Hour)
+	_, err = db.New("pages", "id").Results()
+	if err != nil || len(slow.Queries()) != 0 {
+		t.Fatalf(Format, "Slow query threshold", "0", slow.Queries())
+	}
+
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM pages WHERE id IN ($1,$2,$3)":                      "SELECT * FROM pages WHERE id IN (...)",
+		"SELECT * FROM pages WHERE id IN (?, ?)":                          "SELECT * FROM pages WHERE id IN (...)",
+		"SELECT * FROM pages\n  WHERE title='it''s' AND id > 10 LIMIT 5;": "SELECT * FROM pages WHERE title=? AND id > ? LIMIT ?",
+		`SELECT "col1", t2.id FROM "table 1" WHERE x=$12`:                 `SELECT "col1", t2.id FROM "table 1" WHERE x=?`,
+		"INSERT INTO pages (title,status) VALUES($1,$2)":                  "INSERT INTO pages (title,status) VALUES(...)",
+	}
+	for sql, expected := range tests {
+		if fp := Fingerprint(sql); fp != expected {
+			t.Fatalf(Format, "Fingerprint", expected, fp)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	fake.ExpectQuery(`SELECT`).WillReturnRows([]string{"id"}, []interface{}{1}, []interface{}{2})
+	fake.ExpectExec(`UPDATE`).WillReturnResult(0, 4)
+
+	_, err := db.New("pages", "id").Where("id IN (?,?)", 1, 2).Results()
+	if err != nil {
+		t.Fatalf(Format, "Results", "nil", err)
+	}
+	_, err = db.New("pages", "id").Where("id IN (?,?,?)", 1, 2, 3).Results()
+	if err != nil {
+		t.Fatalf(Format, "Results", "nil", err)
+	}
+	_, err = db.Exec("UPDATE pages SET status=100")
+	if err != nil {
+		t.Fatalf(Format, "Exec", "nil", err)
+	}
+
+	stats := db.Stats()
+	if len(stats) != 2 {
+		t.Fatalf(Format, "Stats", "2 fingerprints", stats)
+	}
+
+	for _, s := range stats {
+		switch s.Fingerprint {
+		case `SELECT "pages".* FROM "pages" WHERE (id IN (...))`:
+			if s.Calls != 2 || s.Rows != 4 || s.Errors != 0 || s.MeanDuration != s.TotalDuration/2 {
+				t.Fatalf(Format, "Select stats", "2 calls 4 rows", s)
+			}
+		case "UPDATE pages SET status=?":
+			if s.Calls != 1 || s.Rows != 4 || s.P95Duration != s.TotalDuration {
+				t.Fatalf(Format, "Update stats", "1 call 4 rows", s)
+			}
+		default:
+			t.Fatalf(Format, "Stats fingerprint", "select or update", s.Fingerprint)
+		}
+	}
+
+	db.ResetStats()
+	if len(db.Stats()) != 0 {
+		t.Fatalf(Format, "ResetStats", "0", db.Stats())
+	}
+
+}
+
+func TestMetrics(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	registry := NewMetricsRegistry(0.5, 1)
+	db.SetMetrics(registry)
+
+	fake.ExpectExec(`DELETE`).WillReturnError(errors.New("locked"))
+
+	_, err := db.New("pages", "id").Results()
+	if err != nil {
+		t.Fatalf(Format, "Results", "nil", err)
+	}
+
+	// Statements within transactions are reported too
+	err = db.Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Results()
+		return err
+	})
+	if err != nil {
+		t.Fatalf(Format, "Transaction", "nil", err)
+	}
+
+	err = db.New("pages", "id").DeleteAll()
+	if err == nil {
+		t.Fatalf(Format, "DeleteAll", "error", err)
+	}
+
+	w := httptest.NewRecorder()
+	registry.Handler(db).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	text := w.Body.String()
+
+	expected := []string{
+		`query_statements_total{operation="Results",table="pages"} 2`,
+		`query_statement_errors_total{operation="DeleteAll",table="pages"} 1`,
+		`query_statement_duration_seconds_bucket{operation="Results",table="pages",le="0.5"} 2`,
+		`query_statement_duration_seconds_bucket{operation="DeleteAll",table="pages",le="+Inf"} 1`,
+		`query_statement_duration_seconds_count{operation="Results",table="pages"} 2`,
+		"# TYPE query_pool_open_connections gauge\nquery_pool_open_connections 1",
+		"query_pool_wait_count_total 0",
+	}
+	for _, e := range expected {
+		if !strings.Contains(text, e) {
+			t.Fatalf(Format, "Metrics text", e, text)
+		}
+	}
+
+	if db.PoolStats().OpenConnections != 1 {
+		t.Fatalf(Format, "PoolStats", "1", db.PoolStats())
+	}
+
+}
+
+// recordingTracer records spans started in memory
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name   string
+	parent *recordingSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type recordingSpanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordingSpanKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, recordingSpanKey{}, span), span
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *recordingSpan) RecordError(err error)                      { s.err = err }
+func (s *recordingSpan) End()                                       { s.ended = true }
+
+func TestTracing(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	tracer := &recordingTracer{}
+	db.AddHook(NewTracingHook(tracer))
+
+	fake.ExpectQuery(`SELECT`).WillReturnRows([]string{"id"}, []interface{}{1}, []interface{}{2})
+	fake.ExpectExec(`UPDATE`).WillReturnResult(0, 2)
+	fake.ExpectExec(`DELETE`).WillReturnError(errors.New("locked"))
+
+	// Start a parent span, as a handler would
+	ctx, parent := tracer.Start(context.Background(), "handler")
+
+	_, err := db.New("pages", "id").Where("id IN (?,?)", 1, 2).ResultsContext(ctx)
+	if err != nil {
+		t.Fatalf(Format, "ResultsContext", "nil", err)
+	}
+	err = db.New("pages", "id").WithContext(ctx).UpdateAll(map[string]string{"title": "traced"})
+	if err != nil {
+		t.Fatalf(Format, "UpdateAll", "nil", err)
+	}
+	err = db.New("pages", "id").DeleteAllContext(ctx)
+	if err == nil {
+		t.Fatalf(Format, "DeleteAllContext", "error", err)
+	}
+	parent.End()
+
+	if len(tracer.spans) != 4 {
+		t.Fatalf(Format, "Spans", "4", len(tracer.spans))
+	}
+
+	results := tracer.spans[1]
+	if results.name != "query.Results" || results.parent != tracer.spans[0] || !results.ended {
+		t.Fatalf(Format, "Results span", "query.Results", results.name)
+	}
+	if results.attrs["db.table"] != "pages" || results.attrs["db.fingerprint"] != `SELECT "pages".* FROM "pages" WHERE (id IN (...))` || results.attrs["db.rows"] != int64(2) {
+		t.Fatalf(Format, "Results span attributes", "pages", results.attrs)
+	}
+
+	update := tracer.spans[2]
+	if update.name != "query.UpdateAll" || update.attrs["db.rows"] != int64(2) || update.err != nil {
+		t.Fatalf(Format, "UpdateAll span", "2 rows", update.attrs)
+	}
+
+	del := tracer.spans[3]
+	if del.name != "query.DeleteAll" || del.err == nil || del.parent != tracer.spans[0] {
+		t.Fatalf(Format, "DeleteAll span", "error", del.err)
+	}
+
+}
+
+func TestCollector(t *testing.T) {
+
+	db, _ := openFake(t, map[string]string{"adapter": "fake"})
+
+	// Statements executed with the context are collected, others are not
+	c := NewCollector()
+	ctx := WithCollector(context.Background(), c)
+
+	_, err := db.New("pages", "id").Where("id=?", 1).ResultsContext(ctx)
+	if err != nil {
+		t.Fatalf(Format, "ResultsContext", "nil", err)
+	}
+	_, err = db.ExecContext(ctx, "UPDATE pages SET status=?", 100)
+	if err != nil {
+		t.Fatalf(Format, "ExecContext", "nil", err)
+	}
+	rows, err := db.RowsContext(ctx, "SELECT id FROM pages")
+	if err != nil {
+		t.Fatalf(Format, "RowsContext", "nil", err)
+	}
+	rows.Close()
+	_, err = db.New("pages", "id").Results()
+	if err != nil {
+		t.Fatalf(Format, "Results", "nil", err)
+	}
+
+	if c.Count() > 3 {
+		t.Fatalf(Format, "Collector count", "at most 3", c.Count())
+	}
+
+	statements := c.Statements()
+	if len(statements) != 3 || statements[0].Operation != "Results" || statements[1].Operation != "Exec" || statements[2].Operation != "Rows" {
+		t.Fatalf(Format, "Collected statements", "Results,Exec,Rows", statements)
+	}
+
+	if statements[1].SQL != "UPDATE pages SET status=?" || statements[1].Args[0] != 100 || !strings.Contains(statements[1].Caller, "query_test.go:") {
+		t.Fatalf(Format, "Collected exec", "UPDATE", statements[1])
+	}
+
+	if c.Duration() < statements[0].Duration {
+		t.Fatalf(Format, "Collector duration", statements[0].Duration, c.Duration())
+	}
+
+	// A collector added as a hook sees every statement on the database
+	all := NewCollector()
+	db.AddHook(all)
+	_, err = db.New("pages", "id").Results()
+	if err != nil || all.Count() != 1 {
+		t.Fatalf(Format, "Collector hook", "1", all.Count())
+	}
+
+	c.Reset()
+	if c.Count() != 0 {
+		t.Fatalf(Format, "Collector reset", "0", c.Count())
+	}
+
+}
+
+func TestNPlusOne(t *testing.T) {
+
+	db, _ := openFake(t, map[string]string{"adapter": "fake"})
+
+	var buf bytes.Buffer
+	db.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	db.SetNPlusOneThreshold(DefaultNPlusOneThreshold)
+
+	c := NewCollector()
+	ctx := WithCollector(context.Background(), c)
+
+	// Look up pages one at a time in a loop, the same id twice
+	for _, id := range []int{1, 2, 2, 3, 4, 5, 6} {
+		_, err := db.New("pages", "id").Where("id=?", id).ResultsContext(ctx)
+		if err != nil {
+			t.Fatalf(Format, "ResultsContext", "nil", err)
+		}
+	}
+
+	// Queries with the same args or other call sites are not N+1
+	for i := 0; i < 10; i++ {
+		_, err := db.New("pages", "id").Where("status=?", 100).ResultsContext(ctx)
+		if err != nil {
+			t.Fatalf(Format, "ResultsContext", "nil", err)
+		}
+	}
+
+	found := c.NPlusOne(DefaultNPlusOneThreshold)
+	if len(found) != 1 || found[0].Count != 6 || !strings.Contains(found[0].Caller, "query_test.go:") || !strings.Contains(found[0].Fingerprint, "id=?") {
+		t.Fatalf(Format, "NPlusOne", "1 site with 6 ids", found)
+	}
+
+	// The warning is logged once, when the threshold is reached
+	if strings.Count(buf.String(), "possible N+1 query") != 1 || !strings.Contains(buf.String(), "WhereIn") || !strings.Contains(buf.String(), found[0].Caller) {
+		t.Fatalf(Format, "NPlusOne warning", "1 warning", buf.String())
+	}
+
+	c.Reset()
+	if len(c.NPlusOne(DefaultNPlusOneThreshold)) != 0 {
+		t.Fatalf(Format, "NPlusOne after Reset", "none", c.NPlusOne(DefaultNPlusOneThreshold))
+	}
+
+}
+
+func TestRowsLeaks(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	var buf syncBuffer
+	db.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	db.SetRowsLeakTimeout(20 * time.Millisecond)
+
+	fake.ExpectQuery(`SELECT`).WillReturnRows([]string{"id"}, []interface{}{1})
+
+	// Rows closed, or read to the end by Results, are not leaks
+	rows, err := db.New("pages", "id").Rows()
+	if err != nil {
+		t.Fatalf(Format, "Rows", "nil", err)
+	}
+	rows.Close()
+	_, err = db.New("pages", "id").Results()
+	if err != nil {
+		t.Fatalf(Format, "Results", "nil", err)
+	}
+
+	leaked, err := db.Rows("SELECT id FROM pages WHERE status=?", 100)
+	if err != nil {
+		t.Fatalf(Format, "Rows", "nil", err)
+	}
+
+	open := db.OpenRows()
+	if len(open) != 1 || open[0].SQL != "SELECT id FROM pages WHERE status=?" || !strings.Contains(open[0].Stack, "TestRowsLeaks") {
+		t.Fatalf(Format, "OpenRows", "1", open)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if strings.Count(buf.String(), "rows not closed after timeout") != 1 || !strings.Contains(buf.String(), "pool_in_use") {
+		t.Fatalf(Format, "Rows leak after timeout", "1 report", buf.String())
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf(Format, "Close", "nil", err)
+	}
+	if !strings.Contains(buf.String(), "rows not closed before database closed") {
+		t.Fatalf(Format, "Rows leak at close", "report", buf.String())
+	}
+	leaked.Close()
+
+}
+
+// syncBuffer is a buffer safe for use by loggers on other goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPlaceholders(t *testing.T) {
+	numbered := func(i int) string { return fmt.Sprintf("$%d", i) }
+	tests := []struct {
+		sql, expected string
+		count         int
+	}{
+		{"id=? AND status=?", "id=$1 AND status=$2", 2},
+		{"title='what?' AND id=?", "title='what?' AND id=$1", 1},
+		{"title='it''s ?' AND \"odd?\"=?", "title='it''s ?' AND \"odd?\"=$1", 1},
+		{"id=? -- why?\nAND x=?", "id=$1 -- why?\nAND x=$2", 2},
+		{"id=? /* ? */ AND x=?", "id=$1 /* ? */ AND x=$2", 2},
+		{"data ?| array['a'] AND data ?& array['b'] AND id=?", "data ?| array['a'] AND data ?& array['b'] AND id=$1", 1},
+		{"data ?? 'key' AND id=?", "data ? 'key' AND id=$1", 1},
+		{"name=?||'x'", "name=$1||'x'", 1},
+		{"body=$$what?$$ AND id=?", "body=$$what?$$ AND id=$1", 1},
+		{"id=$1", "id=$1", 0},
+	}
+	for _, test := range tests {
+		sql, count := rewritePlaceholders(test.sql, numbered, false)
+		if sql != test.expected || count != test.count {
+			t.Fatalf(Format, test.sql, test.expected, sql)
+		}
+	}
+
+	// Mysql escapes quotes in strings with a backslash, but not in quoted identifiers
+	question := func(i int) string { return "?" }
+	mysqlTests := []struct {
+		sql, expected string
+		count         int
+	}{
+		{`title='it\'s ?' AND id=?`, `title='it\'s ?' AND id=?`, 1},
+		{`title="say \"why?\"" AND id=?`, `title="say \"why?\"" AND id=?`, 1},
+		{`title='back\\' AND id=?`, `title='back\\' AND id=?`, 1},
+		{"`odd\\`=? AND id=?", "`odd\\`=? AND id=?", 2},
+	}
+	for _, test := range mysqlTests {
+		sql, count := rewritePlaceholders(test.sql, question, true)
+		if sql != test.expected || count != test.count {
+			t.Fatalf(Format, test.sql, test.expected, fmt.Sprintf("%s (%d)", sql, count))
+		}
+	}
+
+	// Without backslash escapes the quote ends the string, so the ? within it is read as a placeholder
+	sql, _ := rewritePlaceholders(`title='it\'s ?' AND id=?`, numbered, false)
+	if sql != `title='it\'s $1' AND id=?` {
+		t.Fatalf(Format, "Backslash without escapes", `title='it\'s $1' AND id=?`, sql)
+	}
+}
+
+func TestPlaceholderCount(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	_, err := db.New("pages", "id").Where("id=? AND status=?", 1).Results()
+	if err == nil || !strings.Contains(err.Error(), "2 placeholders for 1 args") {
+		t.Fatalf(Format, "Placeholder count", "error", err)
+	}
+
+	_, err = db.New("pages", "id").Where("title='why?' AND id=?", 1).Results()
+	if err != nil {
+		t.Fatalf(Format, "Placeholder in literal", "nil", err)
+	}
+
+	if len(fake.Calls()) != 1 || fake.Calls()[0].SQL != `SELECT "pages".* FROM "pages" WHERE (title='why?' AND id=?);` {
+		t.Fatalf(Format, "Placeholder sql", "1 call", fake.Calls())
+	}
+
+}
+
+func TestNamedParams(t *testing.T) {
+
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sql, args, err := rewriteNamed("status = :status AND (created_at > :since OR updated_at > :since) AND id::text <> ':status'", Params{"status": 100, "since": since}, false)
+	if err != nil || sql != "status = ? AND (created_at > ? OR updated_at > ?) AND id::text <> ':status'" || len(args) != 3 || args[0] != 100 || args[2] != since {
+		t.Fatalf(Format, "rewriteNamed", "3 args", sql)
+	}
+
+	_, _, err = rewriteNamed("status = :status AND id = :id", Params{"status": 100}, false)
+	if err == nil || !strings.Contains(err.Error(), "missing named params id") {
+		t.Fatalf(Format, "Missing named param", "error", err)
+	}
+
+	_, _, err = rewriteNamed("status = :status", Params{"status": 100, "id": 1}, false)
+	if err == nil || !strings.Contains(err.Error(), "unused named params id") {
+		t.Fatalf(Format, "Unused named param", "error", err)
+	}
+
+	sql, _, err = rewriteNamed(`note = 'it\'s :status' AND id = :id`, Params{"id": 1}, true)
+	if err != nil || sql != `note = 'it\'s :status' AND id = ?` {
+		t.Fatalf(Format, "Named param after backslash escape", "nil", err)
+	}
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	_, err = db.New("pages", "id").Where("id > ?", 1).WhereNamed("status = :status OR :status IS NULL", Params{"status": 100}).Results()
+	if err != nil {
+		t.Fatalf(Format, "WhereNamed", "nil", err)
+	}
+
+	_, err = db.New("pages", "id").SQLNamed("SELECT id FROM pages WHERE created_at > :since", Params{"since": since}).Results()
+	if err != nil {
+		t.Fatalf(Format, "SQLNamed", "nil", err)
+	}
+
+	_, err = db.New("pages", "id").WhereNamed("status = :status", Params{}).Results()
+	if err == nil {
+		t.Fatalf(Format, "WhereNamed missing", "error", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 2 {
+		t.Fatalf(Format, "Named calls", "2", calls)
+	}
+	if calls[0].SQL != `SELECT "pages".* FROM "pages" WHERE (id > ?) AND (status = ? OR ? IS NULL);` || len(calls[0].Args) != 3 || calls[0].Args[2] != int64(100) {
+		t.Fatalf(Format, "WhereNamed sql", "3 args", calls[0])
+	}
+	if calls[1].SQL != "SELECT id FROM pages WHERE created_at > ?" || len(calls[1].Args) != 1 {
+		t.Fatalf(Format, "SQLNamed sql", "1 arg", calls[1])
+	}
+
+	// Setters after SQLNamed such as the limit set by FirstResult keep the sql and args
+	fake.ExpectQuery(`SELECT id FROM pages WHERE status = \?`).WillReturnRows([]string{"id"}, []interface{}{3})
+	result, err := db.New("pages", "id").SQLNamed("SELECT id FROM pages WHERE status = :status", Params{"status": 100}).Offset(1).FirstResult()
+	if err != nil || result["id"] != int64(3) {
+		t.Fatalf(Format, "SQLNamed FirstResult", "3", err)
+	}
+	calls = fake.Calls()
+	if calls[2].SQL != "SELECT id FROM pages WHERE status = ?" || len(calls[2].Args) != 1 || calls[2].Args[0] != int64(100) {
+		t.Fatalf(Format, "SQLNamed FirstResult sql", "1 arg", calls[2])
+	}
+
+	// Count builds its own sql, so cannot be used with sql set manually
+	_, err = db.New("pages", "id").SQLNamed("SELECT id FROM pages WHERE status = :status", Params{"status": 100}).Count()
+	if err == nil {
+		t.Fatalf(Format, "SQLNamed Count", "error", err)
+	}
+
+}
+
+func TestClauseArgs(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	// Args are given in sql order whatever order the clauses are set in
+	q := db.New("pages", "id").
+		Order("abs(score - ?)", 6).
+		Having("count(tags.id) > ?", 3).
+		Where("status = ?", 100).
+		Group("pages.id").
+		AddJoinString("LEFT JOIN tags ON tags.page_id = pages.id AND tags.name <> ?", "draft").
+		Select("SELECT pages.*, score * ? AS weighted FROM pages", 2)
+
+	q.QueryString()
+	expected := []interface{}{2, "draft", 100, 3, 6}
+	if fmt.Sprint(q.args) != fmt.Sprint(expected) {
+		t.Fatalf(Format, "Clause args", expected, q.args)
+	}
+
+	// Count drops select and order args, and restores them after
+	_, err := q.Count()
+	if err != nil {
+		t.Fatalf(Format, "Count", "nil", err)
+	}
+	calls := fake.Calls()
+	if len(calls[0].Args) != 3 || calls[0].Args[0] != "draft" {
+		t.Fatalf(Format, "Count args", "draft,100,3", calls[0].Args)
+	}
+	_, err = q.Results()
+	if err != nil || len(fake.Calls()[1].Args) != 5 {
+		t.Fatalf(Format, "Results args", "5", fake.Calls()[1].Args)
+	}
+
+	// Update values come before where args
+	err = db.New("pages", "id").Where("id = ?", 9).UpdateAll(map[string]string{"title": "a", "summary": "b"})
+	if err != nil {
+		t.Fatalf(Format, "UpdateAll", "nil", err)
+	}
+	update := fake.Calls()[2]
+	if fmt.Sprint(update.Args) != "[b a 9]" {
+		t.Fatalf(Format, "UpdateAll args", "[b a 9]", update.Args)
+	}
+
+	// Copies do not share args
+	a := db.New("pages", "id").Where("id > ?", 1)
+	b := a.Copy().Where("status = ?", 100)
+	a.Where("status = ?", 200)
+	a.QueryString()
+	b.QueryString()
+	if fmt.Sprint(a.args) != "[1 200]" || fmt.Sprint(b.args) != "[1 100]" {
+		t.Fatalf(Format, "Copy args", "[1 200] [1 100]", fmt.Sprint(a.args, b.args))
+	}
+
+}
+
+func TestConditions(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := db.New("pages", "id").WhereExpr(And(
+		Eq("status", 100),
+		Or(Gt("pages.created_at", since), IsNull("published_at")),
+		Not(In("id", []int64{1, 2})),
+		Between("score", 1, 5),
+		Like("title", "%go%"),
+		Raw("lower(summary) <> ?", "x"),
+	))
+
+	expected := `SELECT "pages".* FROM "pages" WHERE (("status" = ? AND ("pages"."created_at" > ? OR "published_at" IS NULL) AND NOT ("id" IN (?,?)) AND "score" BETWEEN ? AND ? AND "title" LIKE ? AND (lower(summary) <> ?)));`
+	if q.QueryString() != expected {
+		t.Fatalf(Format, "WhereExpr", expected, q.QueryString())
+	}
+	if fmt.Sprint(q.args) != fmt.Sprint([]interface{}{100, since, int64(1), int64(2), 1, 5, "%go%", "x"}) {
+		t.Fatalf(Format, "WhereExpr args", "8 args", q.args)
+	}
+
+	conds := map[string]Condition{
+		`"a" <> ?`:             Neq("a", 1),
+		`"a" >= ?`:             Gte("a", 1),
+		`"a" < ?`:              Lt("a", 1),
+		`"a" <= ?`:             Lte("a", 1),
+		`"a" IS NOT NULL`:      IsNotNull("a"),
+		`"a" NOT IN (?,?)`:     NotIn("a", []string{"x", "y"}),
+		`1=0`:                  In("a", []string{}),
+		`1=1`:                  And(),
+		`("a" = ? OR "b" = ?)`: Or(Eq("a", 1), Eq("b", 2)),
+		`"b" IS NULL`:          Eq("b", nil),
+		`"b" IS NOT NULL`:      Neq("b", nil),
+	}
+	for sql, cond := range conds {
+		built, _ := cond.build(db.adapter.QuoteField)
+		if built != sql {
+			t.Fatalf(Format, "Condition", sql, built)
+		}
+	}
+
+	// A nil value is compared with IS NULL, as = NULL matches no rows
+	_, args := Eq("b", nil).build(db.adapter.QuoteField)
+	if len(args) != 0 {
+		t.Fatalf(Format, "Eq nil args", "0 args", args)
+	}
+
+	_, err := db.New("pages", "id").WhereExpr(Eq("status", 100)).Results()
+	if err != nil || fake.Calls()[0].SQL != `SELECT "pages".* FROM "pages" WHERE ("status" = ?);` {
+		t.Fatalf(Format, "WhereExpr results", "nil", err)
+	}
+
+}
+
+func TestWhereIn(t *testing.T) {
+
+	db, fake := openFake(t, map[string]string{"adapter": "fake"})
+
+	q := WhereIn(db.New("pages", "id"), "slug", []string{"a", "b"})
+	if q.QueryString() != `SELECT "pages".* FROM "pages" WHERE (slug IN (?,?));` || fmt.Sprint(q.args) != "[a b]" {
+		t.Fatalf(Format, "WhereIn strings", "slug IN (?,?)", q.QueryString())
+	}
+
+	// Empty sets are always false, for every operation
+	err := db.New("pages", "id").WhereIn("id", nil).DeleteAll()
+	if err != nil {
+		t.Fatalf(Format, "DeleteAll empty WhereIn", "nil", err)
+	}
+	err = db.New("pages", "id").WhereIn("id", []int64{}).UpdateAll(map[string]string{"title": "x"})
+	if err != nil {
+		t.Fatalf(Format, "UpdateAll empty WhereIn", "nil", err)
+	}
+	_, err = db.New("pages", "id").WhereIn("id", []int64{}).Count()
+	if err != nil {
+		t.Fatalf(Format, "Count empty WhereIn", "nil", err)
+	}
+	for _, call := range fake.Calls() {
+		if !strings.Contains(call.SQL, "WHERE (1=0)") {
+			t.Fatalf(Format, "Empty WhereIn", "WHERE (1=0)", call.SQL)
+		}
+	}
+
+	q = db.New("pages", "id").WhereNotIn("id", []int64{})
+	if q.QueryString() != `SELECT "pages".* FROM "pages" WHERE (1=1);` {
+		t.Fatalf(Format, "Empty WhereNotIn", "WHERE (1=1)", q.QueryString())
+	}
 
-// Update this model object, called from actions.
-func (p *Page) Update(params map[string]string) error {
-	params["updated_at"] = TimeString(time.Now().UTC())
-	return PagesQuery().Where("id=?", p.ID).Update(params)
 }
 
-// Delete this page
-func (p *Page) Delete() error {
-	return PagesQuery().Where("id=?", p.ID).Delete()
-}
+func TestWhereInChunks(t *testing.T) {
 
-// NewWithColumns creates a new page instance and fills it with data from the database cols provided
-func PagesNewWithColumns(cols map[string]interface{}) *Page {
+	db, fake := openFake(t, map[string]string{"adapter": "fake", "in_chunk_size": "2"})
 
-	page := PagesNew()
+	ids := []int64{1, 2, 3, 4, 5}
+	fake.ExpectQuery(`SELECT "pages"\.\*`).WillReturnRows([]string{"id"}, []interface{}{1}, []interface{}{2})
+	fake.ExpectQuery(`COUNT`).WillReturnRows([]string{"count"}, []interface{}{2})
+	fake.ExpectExec(`UPDATE`).WillReturnResult(0, 2)
 
-	// Normally you'd validate col values with something like the model/validate pkg
-	// we'll use a simple dummy function instead
-	page.ID = cols["id"].(int64)
-	if cols["created_at"] != nil {
-		page.CreatedAt = cols["created_at"].(time.Time)
+	// Results are merged from a statement per chunk, with the where args around the chunk kept in place
+	results, err := db.New("pages", "id").Where("status=?", 100).WhereIn("id", ids).Where("title=?", "x").Results()
+	if err != nil || len(results) != 6 {
+		t.Fatalf(Format, "Chunked Results", "6", len(results))
 	}
-	if cols["updated_at"] != nil {
-		page.UpdatedAt = cols["updated_at"].(time.Time)
+	calls := fake.Calls()
+	if len(calls) != 3 || calls[2].SQL != `SELECT "pages".* FROM "pages" WHERE (status=?) AND (id IN (?)) AND (title=?);` {
+		t.Fatalf(Format, "Chunked Results calls", "3", calls)
+	}
+	if fmt.Sprint(calls[0].Args) != "[100 1 2 x]" || fmt.Sprint(calls[2].Args) != "[100 5 x]" {
+		t.Fatalf(Format, "Chunked Results args", "[100 1 2 x]", calls[0].Args)
 	}
 
-	if cols["title"] != nil {
-		page.Title = cols["title"].(string)
+	// A limit is applied to the merged results
+	fake.Reset()
+	fake.ExpectQuery(`SELECT "pages"\.\*`).WillReturnRows([]string{"id"}, []interface{}{1}, []interface{}{2})
+	result, err := db.New("pages", "id").WhereIn("id", ids).FirstResult()
+	if err != nil || result["id"] != int64(1) || len(fake.Calls()) != 1 {
+		t.Fatalf(Format, "Chunked FirstResult", "1 call", fake.Calls())
 	}
-	if cols["summary"] != nil {
-		page.Summary = cols["summary"].(string)
+
+	// Counts are summed, and updates and deletes run per chunk
+	fake.Reset()
+	fake.ExpectQuery(`COUNT`).WillReturnRows([]string{"count"}, []interface{}{2})
+	count, err := db.New("pages", "id").WhereIn("id", ids).Count()
+	if err != nil || count != 6 {
+		t.Fatalf(Format, "Chunked Count", "6", count)
 	}
-	if cols["text"] != nil {
-		page.Text = cols["text"].(string)
+	err = db.New("pages", "id").WhereIn("id", ids).UpdateAll(map[string]string{"title": "x"})
+	if err != nil {
+		t.Fatalf(Format, "Chunked UpdateAll", "nil", err)
+	}
+	err = db.New("pages", "id").WhereIn("id", ids).DeleteAll()
+	if err != nil {
+		t.Fatalf(Format, "Chunked DeleteAll", "nil", err)
+	}
+	calls = fake.Calls()
+	if len(calls) != 13 || fmt.Sprint(calls[6].Args) != "[x 5]" || calls[11].SQL != `DELETE FROM "pages" WHERE (id IN (?));` {
+		t.Fatalf(Format, "Chunked statements", "13", calls)
+	}
+	if calls[3].Method != "Begin" || calls[7].Method != "Commit" {
+		t.Fatalf(Format, "Chunked UpdateAll transaction", "Begin, Commit", calls)
 	}
 
-	return page
-}
+	// If the second chunk fails, the first is rolled back
+	fake.Reset()
+	fake.ExpectExec(`id IN \(\?\)`).WillReturnError(fmt.Errorf("update failed"))
+	err = db.New("pages", "id").WhereIn("id", ids[:3]).UpdateAll(map[string]string{"title": "x"})
+	calls = fake.Calls()
+	if err == nil || len(calls) != 4 || calls[0].Method != "Begin" || calls[3].Method != "Rollback" {
+		t.Fatalf(Format, "Chunked UpdateAll failure", "Rollback", calls)
+	}
 
-// New initialises and returns a new Page
-func PagesNew() *Page {
-	page := &Page{}
-	return page
-}
+	// Within a transaction the chunks are executed on it
+	fake.Reset()
+	err = db.Transaction(func(tx *Tx) error {
+		return tx.New("pages", "id").WhereIn("id", ids).DeleteAll()
+	})
+	calls = fake.Calls()
+	if err != nil || len(calls) != 5 || calls[0].Method != "Begin" || calls[4].Method != "Commit" {
+		t.Fatalf(Format, "Chunked DeleteAll in transaction", "1 transaction", calls)
+	}
 
-// Query returns a new query for pages
-func PagesQuery() *Query {
-	return New("pages", "id")
-}
+	// Counts drop any limit and offset, but may not be split with joins
+	fake.Reset()
+	fake.ExpectQuery(`COUNT`).WillReturnRows([]string{"count"}, []interface{}{2})
+	count, err = db.New("pages", "id").WhereIn("id", ids).Limit(1).Offset(1).Count()
+	if err != nil || count != 6 || strings.Contains(fake.Calls()[0].SQL, "LIMIT") {
+		t.Fatalf(Format, "Chunked Count with limit", "6", err)
+	}
+	_, err = db.New("pages", "id").Join("tags").WhereIn("tags.id", ids).Count()
+	if err == nil {
+		t.Fatalf(Format, "Chunked Count with join", "error", err)
+	}
+	err = db.New("pages", "id").WhereIn("id", ids).Limit(1).DeleteAll()
+	if err == nil {
+		t.Fatalf(Format, "Chunked DeleteAll with limit", "error", err)
+	}
 
-func PagesFind(ID int64) (*Page, error) {
-	result, err := PagesQuery().Where("id=?", ID).FirstResult()
-	if err != nil {
-		return nil, err
+	// Repeated values are removed, so that no row is selected by two chunks
+	fake.Reset()
+	fake.ExpectQuery(`COUNT`).WillReturnRows([]string{"count"}, []interface{}{1})
+	count, err = db.New("pages", "id").WhereIn("id", []int64{1, 2, 1, 3, 1}).Count()
+	calls = fake.Calls()
+	if err != nil || count != 2 || len(calls) != 2 || fmt.Sprint(calls[0].Args, calls[1].Args) != "[1 2] [3]" {
+		t.Fatalf(Format, "Chunked repeated ids", "[1 2] [3]", calls)
 	}
-	return PagesNewWithColumns(result), nil
-}
 
-func PagesFindAll(q *Query) ([]*Page, error) {
-	results, err := q.Results()
-	if err != nil {
-		return nil, err
+	// Results ordered by plain columns are sorted once merged, before the limit is applied
+	fake.Reset()
+	fake.ExpectQuery(`SELECT`).WillReturnRows([]string{"id", "title"}, []interface{}{1, "b"}, []interface{}{2, "a"})
+	results, err = db.New("pages", "id").WhereIn("id", ids).Order(`"pages"."title" asc, id DESC`).Limit(4).Results()
+	if err != nil || len(results) != 4 || len(fake.Calls()) != 3 || results[0]["title"] != "a" || results[3]["title"] != "b" {
+		t.Fatalf(Format, "Chunked order", "a,a,a,b", results)
+	}
+	if !strings.HasSuffix(fake.Calls()[0].SQL, `ORDER BY "pages"."title" asc, id DESC LIMIT 4;`) {
+		t.Fatalf(Format, "Chunked order sql", "ORDER BY in each chunk", fake.Calls()[0].SQL)
 	}
 
-	var models []*Page
-	for _, r := range results {
-		m := PagesNewWithColumns(r)
-		models = append(models, m)
+	// OR conditions within a clause may be split, but OrWhere may not
+	fake.Reset()
+	_, err = db.New("pages", "id").WhereIn("id", ids).WhereExpr(Or(Raw("status=?", 1), Raw("status=?", 2))).Count()
+	if err != nil || len(fake.Calls()) != 3 {
+		t.Fatalf(Format, "Chunked Or condition", "3 calls", err)
 	}
 
-	return models, nil
-}
+	// Queries which cannot be merged are returned as errors
+	fake.Reset()
+	_, err = db.New("pages", "id").WhereIn("id", ids).Order("lower(title)").Results()
+	if err == nil {
+		t.Fatalf(Format, "Chunked order by expression", "error", err)
+	}
+	_, err = db.New("pages", "id").WhereIn("id", ids).OrWhere("id=?", 9).Count()
+	if err == nil {
+		t.Fatalf(Format, "Chunked OrWhere", "error", err)
+	}
+	_, err = db.New("pages", "id").WhereNotIn("id", ids).Results()
+	if err == nil {
+		t.Fatalf(Format, "Chunked WhereNotIn", "error", err)
+	}
+	_, err = db.New("pages", "id").WhereIn("id", ids).Rows()
+	if err == nil || len(fake.Calls()) != 0 {
+		t.Fatalf(Format, "Chunked Rows", "error", err)
+	}
 
-// ----------------------------------
-// Test Helpers
-// ----------------------------------
+	// Lists within the chunk size are bound as usual
+	q := db.New("pages", "id").WhereIn("id", ids[:2])
+	if q.QueryString() != `SELECT "pages".* FROM "pages" WHERE (id IN (?,?));` {
+		t.Fatalf(Format, "Short WhereIn", "id IN (?,?)", q.QueryString())
+	}
 
-var User = os.ExpandEnv("$USER")
-var Password = os.ExpandEnv("$QUERY_TEST_PASS") // may be blank
+	// Postgres binds long lists as a single array
+	sqlDB, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf(Format, "Open sqlite", "nil", err)
+	}
+	defer sqlDB.Close()
+	psql := &adapters.PostgresqlAdapter{}
+	err = psql.OpenWithSQLDB(sqlDB, map[string]string{"in_chunk_size": "2"})
+	if err != nil {
+		t.Fatalf(Format, "Open psql", "nil", err)
+	}
+	pdb := newDB(psql, map[string]string{"adapter": "postgres"})
+	defer pdb.Close()
+	q = WhereNotIn(pdb.New("pages", "id"), "slug", []string{"a", "b", "c"})
+	if q.QueryString() != `SELECT "pages".* FROM "pages" WHERE (NOT (slug = ANY($1)));` || len(q.args) != 1 {
+		t.Fatalf(Format, "psql array WhereNotIn", "slug = ANY($1)", q.QueryString())
+	}
 
-var Format = "\n---\nFAILURE\n---\ninput:    %q\nexpected: %q\noutput:   %q"
+}
 
 // ----------------------------------
 // PSQL TESTS
@@ -269,6 +1667,41 @@ func TestPQSelect(t *testing.T) {
 
 }
 
+func TestPQStmtCache(t *testing.T) {
+
+	// Running the same query twice should reuse the cached statement
+	before := database.StmtCacheStats()
+	for i := 0; i < 2; i++ {
+		_, err := PagesQuery().Where("id=?", 1).Where("title IS NOT NULL").Results()
+		if err != nil {
+			t.Fatalf(Format, "Stmt cache query", "nil", err)
+		}
+	}
+	after := database.StmtCacheStats()
+	if after.Hits <= before.Hits || after.Size == 0 {
+		t.Fatalf(Format, "Stmt cache stats", "hits", after)
+	}
+
+}
+
+func TestPQContext(t *testing.T) {
+
+	// A cancelled context should be passed on and abort the query
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := PagesQuery().CountContext(ctx)
+	if err == nil {
+		t.Fatalf(Format, "Count with cancelled context", "error", err)
+	}
+
+	// A live context should work as normal
+	results, err := PagesQuery().Where("id < ?", 3).ResultsContext(context.Background())
+	if err != nil || len(results) != 2 {
+		t.Fatalf(Format, "Results with context", "len 2", err)
+	}
+
+}
+
 // Some more damaging operations we execute at the end,
 // to avoid having to reload the db for each test
 
@@ -389,6 +1822,104 @@ func TestPQDeleteAll(t *testing.T) {
 
 }
 
+func TestPQTransaction(t *testing.T) {
+
+	params := map[string]string{"title": "Transaction", "created_at": TimeString(time.Now().UTC()), "updated_at": TimeString(time.Now().UTC())}
+
+	// An error returned should roll back the insert
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatalf(Format, "Transaction rollback", "rollback", err)
+	}
+
+	count, err := PagesQuery().Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count after rollback", "1", fmt.Sprintf("%d", count))
+	}
+
+	// A nil error should commit the insert
+	err = Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		return err
+	})
+	if err != nil {
+		t.Fatalf(Format, "Transaction commit", "nil", err)
+	}
+
+	count, err = PagesQuery().Count()
+	if err != nil || count != 2 {
+		t.Fatalf(Format, "Count after commit", "2", fmt.Sprintf("%d", count))
+	}
+
+}
+
+func TestPQNestedTransaction(t *testing.T) {
+
+	params := map[string]string{"title": "Nested", "created_at": TimeString(time.Now().UTC()), "updated_at": TimeString(time.Now().UTC())}
+
+	// The outer insert should be committed, the inner insert rolled back to its savepoint
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Transaction(func(tx *Tx) error {
+			_, err := tx.New("pages", "id").Insert(params)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("rollback inner")
+		})
+		if err == nil || err.Error() != "rollback inner" {
+			return fmt.Errorf("unexpected inner error:%v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(Format, "Nested transaction", "nil", err)
+	}
+
+	count, err := PagesQuery().Where("title=?", "Nested").Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count after nested transaction", "1", fmt.Sprintf("%d", count))
+	}
+
+}
+
+func TestPQTransactionWithRetry(t *testing.T) {
+
+	// Fail with a retryable error on the first attempt only
+	calls := 0
+	attempts, err := TransactionWithRetry(&RetryOptions{Backoff: time.Millisecond}, func(tx *Tx) error {
+		calls++
+		if calls == 1 {
+			return &pq.Error{Code: "40001"}
+		}
+		_, err := tx.New("pages", "id").Where("id=?", 1).Results()
+		return err
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf(Format, "Transaction with retry", "2 attempts", fmt.Sprintf("%d %v", attempts, err))
+	}
+
+	// Other errors should not be retried
+	attempts, err = TransactionWithRetry(nil, func(tx *Tx) error {
+		return fmt.Errorf("not retryable")
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf(Format, "Transaction with retry", "1 attempt", fmt.Sprintf("%d %v", attempts, err))
+	}
+
+}
+
 // This test takes some time, so only enable for speed testing
 func BenchmarkPQSpeed(t *testing.B) {
 
@@ -702,6 +2233,104 @@ func TestMysqlDeleteAll(t *testing.T) {
 
 }
 
+func TestMysqlTransaction(t *testing.T) {
+
+	params := map[string]string{"title": "Transaction", "created_at": TimeString(time.Now().UTC()), "updated_at": TimeString(time.Now().UTC())}
+
+	// An error returned should roll back the insert
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatalf(Format, "Transaction rollback", "rollback", err)
+	}
+
+	count, err := PagesQuery().Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count after rollback", "1", fmt.Sprintf("%d", count))
+	}
+
+	// A nil error should commit the insert
+	err = Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		return err
+	})
+	if err != nil {
+		t.Fatalf(Format, "Transaction commit", "nil", err)
+	}
+
+	count, err = PagesQuery().Count()
+	if err != nil || count != 2 {
+		t.Fatalf(Format, "Count after commit", "2", fmt.Sprintf("%d", count))
+	}
+
+}
+
+func TestMysqlNestedTransaction(t *testing.T) {
+
+	params := map[string]string{"title": "Nested", "created_at": TimeString(time.Now().UTC()), "updated_at": TimeString(time.Now().UTC())}
+
+	// The outer insert should be committed, the inner insert rolled back to its savepoint
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Transaction(func(tx *Tx) error {
+			_, err := tx.New("pages", "id").Insert(params)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("rollback inner")
+		})
+		if err == nil || err.Error() != "rollback inner" {
+			return fmt.Errorf("unexpected inner error:%v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(Format, "Nested transaction", "nil", err)
+	}
+
+	count, err := PagesQuery().Where("title=?", "Nested").Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count after nested transaction", "1", fmt.Sprintf("%d", count))
+	}
+
+}
+
+func TestMysqlTransactionWithRetry(t *testing.T) {
+
+	// Fail with a retryable error on the first attempt only
+	calls := 0
+	attempts, err := TransactionWithRetry(&RetryOptions{Backoff: time.Millisecond}, func(tx *Tx) error {
+		calls++
+		if calls == 1 {
+			return &mysql.MySQLError{Number: 1213}
+		}
+		_, err := tx.New("pages", "id").Where("id=?", 1).Results()
+		return err
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf(Format, "Transaction with retry", "2 attempts", fmt.Sprintf("%d %v", attempts, err))
+	}
+
+	// Other errors should not be retried
+	attempts, err = TransactionWithRetry(nil, func(tx *Tx) error {
+		return fmt.Errorf("not retryable")
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf(Format, "Transaction with retry", "1 attempt", fmt.Sprintf("%d %v", attempts, err))
+	}
+
+}
+
 func TestMysqlTeardown(t *testing.T) {
 
 	err := CloseDatabase()
@@ -710,8 +2339,6 @@ func TestMysqlTeardown(t *testing.T) {
 	}
 }
 
-/*
-// See note in adapters/database_sqlite.go for reasons this is disabled
 // ----------------------------------
 // SQLITE TESTS
 // ----------------------------------
@@ -720,39 +2347,31 @@ func TestSQSetup(t *testing.T) {
 
 	fmt.Println("\n---\nTESTING SQLITE\n---")
 
-	// NB we use binary named sqlite3 - this is the default on OS X
-	// NB this requires sqlite3 version > 3.7.15 for init alternative would be to echo sql file at end
-	cmd := exec.Command("sqlite3", "--init", "tests/query_test_sqlite.sql", "tests/query_test.sqlite")
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-	err = cmd.Start()
-	if err != nil {
-		fmt.Println("Could not set up sqlite db - ERROR ", err)
-		os.Exit(1)
+	// Open an in memory database, which requires no server
+	options := map[string]string{
+		"adapter": "sqlite3",
+		"db":      ":memory:",
+		"debug":   "true", // for more detail on failure, enable debug mode on db
 	}
-	go io.Copy(os.Stdout, stdout)
-	go io.Copy(os.Stderr, stderr)
-	cmd.Wait()
 
-	if err == nil {
-		_ = strings.Replace("", "", "", -1)
-
-		// Open the database
-		options := map[string]string{
-			"adapter": "sqlite3",
-			"db":      "tests/query_test.sqlite",
-			"debug":   "true", // for more detail on failure, enable debug mode on db
-		}
+	err := OpenDatabase(options)
+	if err != nil {
+		t.Fatalf("SQLITE DB ERROR: %s", err)
+	}
 
-		err = OpenDatabase(options)
-		if err != nil {
-			fmt.Println("Open database ERROR ", err)
-			os.Exit(1)
-		}
+	// Load the test data
+	bytes, err := ioutil.ReadFile("./tests/query_test_sqlite.sql")
+	if err != nil {
+		t.Fatalf("SQLITE DB ERROR: %s", err)
+	}
 
-		fmt.Println("---\nQuery Testing Sqlite3 - DB setup complete\n---")
+	_, err = database.Adapter().SQLDB().Exec(string(bytes))
+	if err != nil {
+		t.Fatalf("SQLITE DB ERROR: %s", err)
 	}
 
+	fmt.Println("---\nQuery Testing Sqlite3 - DB setup complete\n---")
+
 }
 
 func TestSQFind(t *testing.T) {
@@ -810,6 +2429,22 @@ func TestSQCount(t *testing.T) {
 		t.Fatalf(Format, "Where Array after count", "len 2", err)
 	}
 
+	// An empty IN selects nothing, even for counts which ignore limit
+	count, err = PagesQuery().WhereIn("id", []int64{}).Count()
+	if err != nil || count != 0 {
+		t.Fatalf(Format, "Count empty WhereIn", "0", fmt.Sprintf("%d", count), err)
+	}
+
+	count, err = WhereIn(PagesQuery(), "title", []string{"Title 1.", "Title 2"}).Count()
+	if err != nil || count != 2 {
+		t.Fatalf(Format, "Count WhereIn strings", "2", fmt.Sprintf("%d", count), err)
+	}
+
+	count, err = WhereNotIn(PagesQuery(), "id", []int{1}).Count()
+	if err != nil || count != 2 {
+		t.Fatalf(Format, "Count WhereNotIn", "2", fmt.Sprintf("%d", count), err)
+	}
+
 }
 
 func TestSQWhere(t *testing.T) {
@@ -984,6 +2619,78 @@ func TestSQDeleteAll(t *testing.T) {
 
 }
 
+func TestSQTransaction(t *testing.T) {
+
+	params := map[string]string{"title": "Transaction", "created_at": TimeString(time.Now().UTC()), "updated_at": TimeString(time.Now().UTC())}
+
+	// An error returned should roll back the insert
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil || err.Error() != "rollback" {
+		t.Fatalf(Format, "Transaction rollback", "rollback", err)
+	}
+
+	count, err := PagesQuery().Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count after rollback", "1", fmt.Sprintf("%d", count))
+	}
+
+	// A nil error should commit the insert
+	err = Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		return err
+	})
+	if err != nil {
+		t.Fatalf(Format, "Transaction commit", "nil", err)
+	}
+
+	count, err = PagesQuery().Count()
+	if err != nil || count != 2 {
+		t.Fatalf(Format, "Count after commit", "2", fmt.Sprintf("%d", count))
+	}
+
+}
+
+func TestSQNestedTransaction(t *testing.T) {
+
+	params := map[string]string{"title": "Nested", "created_at": TimeString(time.Now().UTC()), "updated_at": TimeString(time.Now().UTC())}
+
+	// The outer insert should be committed, the inner insert rolled back to its savepoint
+	err := Transaction(func(tx *Tx) error {
+		_, err := tx.New("pages", "id").Insert(params)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Transaction(func(tx *Tx) error {
+			_, err := tx.New("pages", "id").Insert(params)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("rollback inner")
+		})
+		if err == nil || err.Error() != "rollback inner" {
+			return fmt.Errorf("unexpected inner error:%v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf(Format, "Nested transaction", "nil", err)
+	}
+
+	count, err := PagesQuery().Where("title=?", "Nested").Count()
+	if err != nil || count != 1 {
+		t.Fatalf(Format, "Count after nested transaction", "1", fmt.Sprintf("%d", count))
+	}
+
+}
+
 func TestSQTeardown(t *testing.T) {
 
 	err := CloseDatabase()
@@ -991,4 +2698,3 @@ func TestSQTeardown(t *testing.T) {
 		fmt.Println("Close DB ERROR ", err)
 	}
 }
-*/
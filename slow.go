@@ -0,0 +1,179 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSlowQueryLogSize is the number of slow queries kept by default
+const DefaultSlowQueryLogSize = 100
+
+// SlowQuery records a statement which took longer than the slow query threshold
+type SlowQuery struct {
+	Time      time.Time     `json:"time"`
+	Operation string        `json:"operation"`
+	Table     string        `json:"table"`
+	SQL       string        `json:"sql"`
+	Args      []interface{} `json:"args"`
+	Duration  time.Duration `json:"duration"`
+	Caller    string        `json:"caller"`
+	Err       string        `json:"error,omitempty"`
+}
+
+// SlowQueryLog is a hook which records statements taking at least threshold to execute,
+// keeping the most recent in a ring buffer and optionally writing them to a logger.
+// Add it to a database with AddHook.
+type SlowQueryLog struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	logger    *slog.Logger
+	queries   []SlowQuery
+	next      int
+	full      bool
+}
+
+// NewSlowQueryLog returns a slow query log recording statements which take at least threshold,
+// keeping the last size statements (DefaultSlowQueryLogSize if size is 0 or less)
+func NewSlowQueryLog(threshold time.Duration, size int) *SlowQueryLog {
+	if size <= 0 {
+		size = DefaultSlowQueryLogSize
+	}
+	return &SlowQueryLog{
+		threshold: threshold,
+		queries:   make([]SlowQuery, size),
+	}
+}
+
+// SetThreshold sets the duration above which statements are recorded
+func (l *SlowQueryLog) SetThreshold(threshold time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.threshold = threshold
+}
+
+// SetLogger sets a logger which slow queries are written to at warn level, nil disables logging
+func (l *SlowQueryLog) SetLogger(logger *slog.Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger = logger
+}
+
+// Before conforms to Hook, and does nothing
+func (l *SlowQueryLog) Before(ctx context.Context, e *Event) context.Context {
+	return ctx
+}
+
+// After records the statement if it took longer than the threshold
+func (l *SlowQueryLog) After(ctx context.Context, e *Event) {
+	l.mu.Lock()
+	threshold, logger := l.threshold, l.logger
+	l.mu.Unlock()
+
+	if e.Duration < threshold {
+		return
+	}
+
+	sq := SlowQuery{
+		Time:      e.Start,
+		Operation: e.Operation,
+		Table:     e.Table,
+		SQL:       e.SQL,
+		Args:      e.Args,
+		Duration:  e.Duration,
+		Caller:    caller(),
+	}
+	if e.Err != nil {
+		sq.Err = e.Err.Error()
+	}
+
+	l.mu.Lock()
+	l.queries[l.next] = sq
+	l.next = (l.next + 1) % len(l.queries)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+
+	if logger != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "query: slow query",
+			slog.String("sql", sq.SQL),
+			slog.Any("args", sq.Args),
+			slog.Duration("duration", sq.Duration),
+			slog.String("caller", sq.Caller),
+			slog.String("table", sq.Table),
+			slog.String("operation", sq.Operation),
+		)
+	}
+}
+
+// Queries returns the slow queries recorded, oldest first
+func (l *SlowQueryLog) Queries() []SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]SlowQuery(nil), l.queries[:l.next]...)
+	}
+	queries := append([]SlowQuery(nil), l.queries[l.next:]...)
+	return append(queries, l.queries[:l.next]...)
+}
+
+// Reset clears the slow queries recorded
+func (l *SlowQueryLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = make([]SlowQuery, len(l.queries))
+	l.next = 0
+	l.full = false
+}
+
+// ServeHTTP writes the slow queries recorded as json, oldest first,
+// so that the log may be mounted on an admin endpoint
+func (l *SlowQueryLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(l.Queries())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// packageDir is the directory of this package, used to skip our own frames when finding callers
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// caller returns the file:line of the first caller outside this package and database/sql
+func caller() string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !internalFrame(frame) {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// internalFrame returns true if the frame is within this package (excluding tests), the adapters or the runtime
+func internalFrame(frame runtime.Frame) bool {
+	if strings.HasPrefix(frame.Function, "database/sql.") || strings.HasPrefix(frame.Function, "runtime.") {
+		return true
+	}
+	dir := filepath.Dir(frame.File)
+	if dir == filepath.Join(packageDir, "adapters") {
+		return true
+	}
+	return dir == packageDir && !strings.HasSuffix(frame.File, "_test.go")
+}
@@ -0,0 +1,247 @@
+package query
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsSampleSize is the number of recent durations kept per fingerprint to estimate p95
+const statsSampleSize = 256
+
+// statsFingerprintCacheSize bounds the cache of fingerprints by sql
+const statsFingerprintCacheSize = 1000
+
+// StatementStats aggregates executions of statements sharing a fingerprint
+type StatementStats struct {
+	Fingerprint string
+
+	// Calls executed and calls which returned an error
+	Calls  int64
+	Errors int64
+
+	// Rows affected by statements, or read by Results
+	Rows int64
+
+	// Total and mean duration of all calls, p95 is estimated from recent calls
+	TotalDuration time.Duration
+	MeanDuration  time.Duration
+	P95Duration   time.Duration
+}
+
+// statementStats accumulates stats for one fingerprint
+type statementStats struct {
+	StatementStats
+	samples []time.Duration
+	next    int
+}
+
+// stats holds statement stats for a database
+type stats struct {
+	mu           sync.Mutex
+	statements   map[string]*statementStats
+	fingerprints map[string]string
+}
+
+func newStats() *stats {
+	return &stats{
+		statements:   make(map[string]*statementStats),
+		fingerprints: make(map[string]string),
+	}
+}
+
+// fingerprint returns the fingerprint for sql, caching it - callers must hold the lock
+func (s *stats) fingerprint(sql string) string {
+	fp, ok := s.fingerprints[sql]
+	if !ok {
+		if len(s.fingerprints) >= statsFingerprintCacheSize {
+			s.fingerprints = make(map[string]string)
+		}
+		fp = Fingerprint(sql)
+		s.fingerprints[sql] = fp
+	}
+	return fp
+}
+
+// statement returns the stats for the fingerprint of sql - callers must hold the lock
+func (s *stats) statement(sql string) *statementStats {
+	fp := s.fingerprint(sql)
+	st := s.statements[fp]
+	if st == nil {
+		st = &statementStats{StatementStats: StatementStats{Fingerprint: fp}}
+		s.statements[fp] = st
+	}
+	return st
+}
+
+// record adds the statement described by e to the stats
+func (s *stats) record(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.statement(e.SQL)
+	st.Calls++
+	if e.Err != nil {
+		st.Errors++
+	}
+	if e.RowsAffected > 0 {
+		st.Rows += e.RowsAffected
+	}
+	st.TotalDuration += e.Duration
+
+	if len(st.samples) < statsSampleSize {
+		st.samples = append(st.samples, e.Duration)
+	} else {
+		st.samples[st.next] = e.Duration
+		st.next = (st.next + 1) % statsSampleSize
+	}
+}
+
+// snapshot returns the stats for each fingerprint, by descending total duration
+func (s *stats) snapshot() []StatementStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var snapshot []StatementStats
+	for _, st := range s.statements {
+		ss := st.StatementStats
+		if ss.Calls > 0 {
+			ss.MeanDuration = ss.TotalDuration / time.Duration(ss.Calls)
+		}
+		ss.P95Duration = percentile(st.samples, 0.95)
+		snapshot = append(snapshot, ss)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].TotalDuration == snapshot[j].TotalDuration {
+			return snapshot[i].Fingerprint < snapshot[j].Fingerprint
+		}
+		return snapshot[i].TotalDuration > snapshot[j].TotalDuration
+	})
+	return snapshot
+}
+
+// reset clears all stats
+func (s *stats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = make(map[string]*statementStats)
+}
+
+// percentile returns the pth percentile (0-1) of the durations given
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Stats returns a snapshot of statement stats by fingerprint for this database,
+// ordered by descending total duration
+func (db *DB) Stats() []StatementStats {
+	return db.stats.snapshot()
+}
+
+// ResetStats clears the statement stats for this database
+func (db *DB) ResetStats() {
+	db.stats.reset()
+}
+
+// Stats returns a snapshot of statement stats for the default database
+func Stats() []StatementStats {
+	return database.Stats()
+}
+
+// ResetStats clears the statement stats for the default database
+func ResetStats() {
+	database.ResetStats()
+}
+
+// placeholderList matches a parenthesised list of placeholders, after normalisation
+var placeholderList = regexp.MustCompile(`\(\s*\?(\s*,\s*\?)*\s*\)`)
+
+// Fingerprint normalises sql so that statements differing only in literals or
+// placeholders share a fingerprint. String and numeric literals and placeholders
+// ($1 or ?) become ?, lists of them become (...), and whitespace is collapsed,
+// so that IN ($1,$2,$3) becomes IN (...).
+func Fingerprint(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+
+	space := false
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+
+		// Collapse runs of whitespace to one space
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			space = true
+			continue
+		}
+		if space {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+		}
+
+		switch {
+		case c == '\'':
+			// String literal, where '' is an escaped quote
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			b.WriteByte('?')
+		case c == '"' || c == '`':
+			// Quoted identifier, copied verbatim
+			j := i + 1
+			for j < len(sql) && sql[j] != c {
+				j++
+			}
+			if j == len(sql) {
+				j--
+			}
+			b.WriteString(sql[i : j+1])
+			i = j
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			for i+1 < len(sql) && isDigit(sql[i+1]) {
+				i++
+			}
+			b.WriteByte('?')
+		case isDigit(c) && (i == 0 || !isIdentifier(sql[i-1])):
+			for i+1 < len(sql) && (isDigit(sql[i+1]) || sql[i+1] == '.') {
+				i++
+			}
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	fp := strings.TrimSuffix(b.String(), ";")
+	return placeholderList.ReplaceAllString(fp, "(...)")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifier(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
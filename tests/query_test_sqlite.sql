@@ -1,5 +1,5 @@
 /* Database created using sqlite for tests - query_test */
-DROP TABLE pages;
+DROP TABLE IF EXISTS pages;
 CREATE TABLE pages (
     id integer NOT NULL PRIMARY KEY,
     title text,
@@ -13,6 +13,6 @@ CREATE TABLE pages (
 );
 
 
-insert into pages VALUES(1,'Title 1.','test 1 text','keywords1',100,'2013-03-18 12:18:50.447 +0000','2013-03-18 12:18:50.447 +0000','test.example.com','');
-insert into pages VALUES(2,'Title 2','test 2 text','keywords 2',100,'2013-03-18 12:18:50.447 +0000','2013-03-18 12:18:50.447 +0000','test.example.com','');
-insert into pages VALUES(3,'Title 3 here','test 3 text','keywords,3',100,'2013-03-18 12:18:50.447 +0000','2013-03-18 12:18:50.447 +0000','test.example.com','');
\ No newline at end of file
+insert into pages VALUES(1,'Title 1.','test 1 text','keywords1',100,'2013-03-18 12:18:50.447+00:00','2013-03-18 12:18:50.447+00:00','test.example.com','');
+insert into pages VALUES(2,'Title 2','test 2 text','keywords 2',100,'2013-03-18 12:18:50.447+00:00','2013-03-18 12:18:50.447+00:00','test.example.com','');
+insert into pages VALUES(3,'Title 3 here','test 3 text','keywords,3',100,'2013-03-18 12:18:50.447+00:00','2013-03-18 12:18:50.447+00:00','test.example.com','');
\ No newline at end of file
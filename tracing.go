@@ -0,0 +1,59 @@
+package query
+
+import (
+	"context"
+)
+
+// Tracer starts spans, and may be implemented by a wrapper around a tracing library.
+// Start should take the parent span from ctx, and return a ctx containing the new span.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// TracingHook is a hook which starts a span for every statement executed,
+// with the operation, table, fingerprint, rows and error as attributes.
+// Pass a context containing the parent span with WithContext or the Context methods.
+type TracingHook struct {
+	tracer Tracer
+}
+
+// NewTracingHook returns a hook which starts spans with tracer, add it to a database with AddHook
+func NewTracingHook(tracer Tracer) *TracingHook {
+	return &TracingHook{tracer: tracer}
+}
+
+// spanKey is the context key used to pass the span from Before to After for a hook
+type spanKey struct {
+	hook *TracingHook
+}
+
+// Before starts a span named query.<operation>, e.g. query.Results
+func (h *TracingHook) Before(ctx context.Context, e *Event) context.Context {
+	ctx, span := h.tracer.Start(ctx, "query."+e.Operation)
+	span.SetAttribute("db.operation", e.Operation)
+	span.SetAttribute("db.table", e.Table)
+	span.SetAttribute("db.fingerprint", Fingerprint(e.SQL))
+	return context.WithValue(ctx, spanKey{h}, span)
+}
+
+// After records rows affected or read by Results and any error on the span and ends it
+func (h *TracingHook) After(ctx context.Context, e *Event) {
+	span, ok := ctx.Value(spanKey{h}).(Span)
+	if !ok {
+		return
+	}
+	if e.RowsAffected >= 0 {
+		span.SetAttribute("db.rows", e.RowsAffected)
+	}
+	if e.Err != nil {
+		span.RecordError(e.Err)
+	}
+	span.End()
+}
@@ -0,0 +1,253 @@
+package query
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Tx is a transaction on a database, queries built with tx.New execute within it.
+type Tx struct {
+	// A handle whose adapter executes statements on this transaction
+	db *DB
+
+	ctx context.Context
+	tx  *sql.Tx
+
+	// A count of savepoints used to generate unique names for nested transactions
+	savepoints int
+}
+
+// Begin starts a transaction on this database with the given options (which may be nil).
+// Options allow setting the isolation level and read-only mode.
+func (db *DB) Begin(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+
+	sqlDB := db.adapter.SQLDB()
+	if sqlDB == nil {
+		return nil, fmt.Errorf("query: begin called with no database available")
+	}
+
+	tx, err := sqlDB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transaction shares hooks, logging, stats, metrics and rows tracking with db
+	txdb := *db
+	txdb.adapter = db.adapter.WithTx(tx)
+	txdb.inTx = true
+
+	t := &Tx{
+		db:  &txdb,
+		ctx: ctx,
+		tx:  tx,
+	}
+
+	return t, nil
+}
+
+// Transaction runs fn within a transaction on this database.
+// The transaction is committed if fn returns nil, and rolled back if fn returns an error or panics.
+func (db *DB) Transaction(fn func(tx *Tx) error) error {
+	return db.TransactionContext(context.Background(), nil, fn)
+}
+
+// TransactionContext runs fn within a transaction using the given context and options (which may be nil).
+// The transaction is committed if fn returns nil, and rolled back if fn returns an error or panics.
+func (db *DB) TransactionContext(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) (err error) {
+
+	tx, err := db.Begin(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	// Roll back and pass the panic on if fn panics
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		rerr := tx.Rollback()
+		if rerr != nil {
+			return fmt.Errorf("query: rollback error:%s after error:%w", rerr, err)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Transaction runs fn within a nested transaction, using a savepoint within this transaction.
+// If fn returns an error or panics, the work done by fn is rolled back to the savepoint,
+// and the outer transaction may continue. If fn returns nil the savepoint is released.
+func (tx *Tx) Transaction(fn func(tx *Tx) error) (err error) {
+
+	// Generate a name unique within this transaction
+	tx.savepoints++
+	name := fmt.Sprintf("query_savepoint_%d", tx.savepoints)
+
+	err = tx.savepoint(tx.db.adapter.SavepointSQL(name))
+	if err != nil {
+		return err
+	}
+
+	// Roll back to the savepoint and pass the panic on if fn panics
+	defer func() {
+		if p := recover(); p != nil {
+			tx.savepoint(tx.db.adapter.RollbackSavepointSQL(name))
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		rerr := tx.savepoint(tx.db.adapter.RollbackSavepointSQL(name))
+		if rerr != nil {
+			return fmt.Errorf("query: rollback to savepoint error:%s after error:%w", rerr, err)
+		}
+		return err
+	}
+
+	return tx.savepoint(tx.db.adapter.ReleaseSavepointSQL(name))
+}
+
+// savepoint executes savepoint sql directly on the transaction without preparing it,
+// as mysql does not allow savepoint statements to be prepared
+func (tx *Tx) savepoint(sql string) error {
+	ctx := tx.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, err := tx.tx.ExecContext(ctx, sql)
+	return err
+}
+
+// RetryOptions sets the options used by TransactionWithRetry, zero values are replaced with defaults
+type RetryOptions struct {
+	// Options for each transaction attempt (may be nil)
+	TxOptions *sql.TxOptions
+
+	// The maximum number of attempts, defaults to 3
+	MaxAttempts int
+
+	// The delay before the first retry, defaults to 10ms, doubled on each retry and jittered
+	Backoff time.Duration
+
+	// The maximum delay between attempts, defaults to 1s
+	MaxBackoff time.Duration
+}
+
+// TransactionWithRetry runs fn within a transaction like Transaction, but if the transaction fails with
+// a serialization failure or deadlock (as classified by the adapter), it is rolled back and run again
+// after a jittered backoff, up to opts.MaxAttempts times. opts may be nil to use the defaults.
+// The number of attempts made is returned along with the final error.
+func (db *DB) TransactionWithRetry(opts *RetryOptions, fn func(tx *Tx) error) (int, error) {
+	return db.TransactionWithRetryContext(context.Background(), opts, fn)
+}
+
+// TransactionWithRetryContext runs fn within a transaction using the given context, retrying on
+// serialization failures and deadlocks, see TransactionWithRetry.
+func (db *DB) TransactionWithRetryContext(ctx context.Context, opts *RetryOptions, fn func(tx *Tx) error) (int, error) {
+
+	o := RetryOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.MaxAttempts < 1 {
+		o.MaxAttempts = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 10 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Second
+	}
+
+	attempts := 0
+	backoff := o.Backoff
+	for {
+		attempts++
+		err := db.TransactionContext(ctx, o.TxOptions, fn)
+		if err == nil || attempts >= o.MaxAttempts || !db.adapter.IsRetryable(err) {
+			return attempts, err
+		}
+
+		// Wait for between half and all of the backoff before trying again
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+		if backoff > o.MaxBackoff {
+			backoff = o.MaxBackoff
+		}
+	}
+}
+
+// IsRetryable reports whether the error is a serialization failure or deadlock
+// which may succeed if the transaction is run again
+func (db *DB) IsRetryable(err error) bool {
+	return db.adapter.IsRetryable(err)
+}
+
+// New builds a new Query which executes within this transaction, given the table and primary key
+func (tx *Tx) New(t string, pk string) *Query {
+	return tx.db.New(t, pk).WithContext(tx.ctx)
+}
+
+// Exec the given sql and args within the transaction
+// Returning sql.Result (NB not rows)
+func (tx *Tx) Exec(sql string, args ...interface{}) (sql.Result, error) {
+	return tx.db.ExecContext(tx.ctx, sql, args...)
+}
+
+// Rows executes the given sql and args within the transaction
+// Returning sql.Rows
+func (tx *Tx) Rows(sql string, args ...interface{}) (*sql.Rows, error) {
+	return tx.db.RowsContext(tx.ctx, sql, args...)
+}
+
+// Commit commits the transaction
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+// Rollback aborts the transaction
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+// Transaction runs fn within a transaction on the default database.
+// The transaction is committed if fn returns nil, and rolled back if fn returns an error or panics.
+func Transaction(fn func(tx *Tx) error) error {
+	if database == nil {
+		return fmt.Errorf("query: Transaction called with nil database")
+	}
+	return database.Transaction(fn)
+}
+
+// TransactionContext runs fn within a transaction on the default database using the given context and options.
+func TransactionContext(ctx context.Context, opts *sql.TxOptions, fn func(tx *Tx) error) error {
+	if database == nil {
+		return fmt.Errorf("query: TransactionContext called with nil database")
+	}
+	return database.TransactionContext(ctx, opts, fn)
+}
+
+// TransactionWithRetry runs fn within a transaction on the default database,
+// retrying on serialization failures and deadlocks, see DB.TransactionWithRetry.
+func TransactionWithRetry(opts *RetryOptions, fn func(tx *Tx) error) (int, error) {
+	if database == nil {
+		return 0, fmt.Errorf("query: TransactionWithRetry called with nil database")
+	}
+	return database.TransactionWithRetry(opts, fn)
+}